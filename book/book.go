@@ -3,41 +3,205 @@ package book
 import (
 	"bytes"
 	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 // Immutable!!
 type Book struct {
 	DNS        DNS
 	V4Networks map[string]*V4Network
+	V6Networks map[string]*V6Network
 	Machines   map[string]*Machine
+	// CNAME, MX, TXT and SRV records.
+	Records []dns.RR
+
+	// Indexes built once by FromConfig. See index.go
+	hwaddrIndex  map[string]*Interface
+	machineIndex map[string]*Machine // by hardware address
+	fqdnIndex    map[string][]*Interface
+	ipv4Index    map[string]*Interface
+	ipv6Index    map[string]*Interface
+	duidIndex    map[string]*Interface
+	recordIndex  map[string][]dns.RR
+	// Every name in the book, and their ancestors (empty non-terminals).
+	nameIndex map[string]struct{}
 }
 
 type DNS struct {
-	Listen    string
-	Networks  []string
-	LocalTTL  int
-	GlobalTTL int
+	Listen   string
+	Networks []string
+	LocalTTL int
+	// Deprecated: TTLs of upstream answers are relayed as they are.
+	GlobalTTL       int
+	Upstreams       []string
+	UpstreamTimeout time.Duration
+	Cache           DNSCache
+	Zones           []*Zone
+	// Networks of proxies whose EDNS Client Subnet options are trusted.
+	ClientSubnetProxies []*net.IPNet
+	// Names which can be assigned to interfaces of several machines.
+	SharedNames []string
 }
 
-func (b *Book) LookupIPForHardwareAddr(hwaddr net.HardwareAddr) net.IP {
-	for _, machine := range b.Machines {
-		for _, nic := range machine.Interfaces {
-			if bytes.Compare(nic.HardwareAddr, hwaddr) == 0 {
-				return nic.IPv4Addr
-			}
+type Zone struct {
+	Name        string
+	NameServers []string
+	Hostmaster  string
+	Serial      uint32
+	Refresh     uint32
+	Retry       uint32
+	Expire      uint32
+	NegativeTTL uint32
+}
+
+type DNSCache struct {
+	MaxEntries int
+	MinTTL     int
+	MaxTTL     int
+}
+
+// IsClientSubnetProxy returns true if EDNS Client Subnet option from the
+// address can be used to authorize requests.
+func (d *DNS) IsClientSubnetProxy(ip net.IP) bool {
+	for _, network := range d.ClientSubnetProxies {
+		if network.Contains(ip) {
+			return true
 		}
+	}
+	return false
+}
 
+func (b *Book) LookupIPForHardwareAddr(hwaddr net.HardwareAddr) net.IP {
+	if nic, ok := b.hwaddrIndex[string(hwaddr)]; ok {
+		return nic.IPv4Addr
 	}
 	return nil
 }
+
+func (b *Book) LookupInterfaceForHardwareAddr(hwaddr net.HardwareAddr) *Interface {
+	return b.hwaddrIndex[string(hwaddr)]
+}
+
+func (b *Book) LookupMachineForHardwareAddr(hwaddr net.HardwareAddr) *Machine {
+	return b.machineIndex[string(hwaddr)]
+}
+
+func (b *Book) LookupInterfaceForDUID(duid []byte) *Interface {
+	return b.duidIndex[string(duid)]
+}
+
 func (b *Book) LookupIPForFQDN(fqdn string) net.IP {
-	for _, machine := range b.Machines {
-		for _, nic := range machine.Interfaces {
-			if nic.Fqdn == fqdn {
-				return nic.IPv4Addr
-			}
+	if nics := b.lookupName(fqdn); len(nics) > 0 {
+		return nics[0].IPv4Addr
+	}
+	return nil
+}
+
+func (b *Book) LookupIPv6ForFQDN(fqdn string) net.IP {
+	for _, nic := range b.lookupName(fqdn) {
+		if nic.IPv6Addr != nil {
+			return nic.IPv6Addr
+		}
+	}
+	return nil
+}
+
+// LookupIPsForFQDN returns IPv4 addresses of all interfaces owning the name,
+// in the order of machine names.
+func (b *Book) LookupIPsForFQDN(fqdn string) []net.IP {
+	nics := b.lookupName(fqdn)
+	ips := make([]net.IP, 0, len(nics))
+	for _, nic := range nics {
+		ips = append(ips, nic.IPv4Addr)
+	}
+	return ips
+}
+
+// LookupIPv6sForFQDN returns IPv6 addresses of all interfaces owning the name,
+// in the order of machine names.
+func (b *Book) LookupIPv6sForFQDN(fqdn string) []net.IP {
+	var ips []net.IP
+	for _, nic := range b.lookupName(fqdn) {
+		if nic.IPv6Addr != nil {
+			ips = append(ips, nic.IPv6Addr)
+		}
+	}
+	return ips
+}
+
+// LookupInterfacesForFQDN returns the interfaces owning the name,
+// or matched by a wildcard.
+func (b *Book) LookupInterfacesForFQDN(fqdn string) []*Interface {
+	return b.lookupName(fqdn)
+}
+
+// LookupRecords returns the records of the type owned by the name.
+func (b *Book) LookupRecords(name string, rrtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range b.recordIndex[strings.ToLower(name)] {
+		if rr.Header().Rrtype == rrtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// LookupCNAME returns the alias owned by the name, or nil.
+func (b *Book) LookupCNAME(name string) *dns.CNAME {
+	for _, rr := range b.recordIndex[strings.ToLower(name)] {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			return cname
 		}
+	}
+	return nil
+}
 
+// LookupZone returns the most specific zone which the name belongs to,
+// or nil if disq is not authoritative for the name.
+func (b *Book) LookupZone(name string) *Zone {
+	var found *Zone
+	for _, zone := range b.DNS.Zones {
+		if dns.IsSubDomain(zone.Name, name) && (found == nil || len(zone.Name) > len(found.Name)) {
+			found = zone
+		}
+	}
+	return found
+}
+
+// NameExists reports whether the name owns any data in the book,
+// or is an ancestor of such a name. Names are compared ignoring case.
+func (b *Book) NameExists(name string) bool {
+	_, ok := b.nameIndex[strings.ToLower(name)]
+	return ok
+}
+
+func (b *Book) LookupInterfaceForIP(ip net.IP) *Interface {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return b.ipv4Index[string(ipv4)]
+	}
+	if ipv6 := ip.To16(); ipv6 != nil {
+		return b.ipv6Index[string(ipv6)]
+	}
+	return nil
+}
+
+func (b *Book) LookupV4NetworkForIP(ip net.IP) *V4Network {
+	for _, network := range b.V4Networks {
+		if network.Network.Contains(ip) {
+			return network
+		}
+	}
+	return nil
+}
+
+func (b *Book) LookupV6NetworkForIP(ip net.IP) *V6Network {
+	for _, network := range b.V6Networks {
+		if network.Network.Contains(ip) {
+			return network
+		}
 	}
 	return nil
 }
@@ -51,6 +215,57 @@ type V4Network struct {
 	NameServerAddrs   []net.IP
 	GatewayAddr       net.IP
 	LeaseDurationDays float64
+	HostName          HostNameSource
+	DomainName        string // empty if not configured.
+	DomainSearch      []string
+	DHCP4Options      []DHCP4Option
+	Boot              *Boot  // nil if network boot is not configured.
+	TFTPListen        string // empty if TFTP server is disabled.
+	TFTPRoot          string // absolute path to the directory served by TFTP.
+	// Addresses for machines not in the book. nil if they are ignored.
+	DynamicRange *AddressRange
+	// Probe addresses before offering them for the first time.
+	Probe bool
+	// How long addresses in conflict are not offered.
+	ConflictCooldown time.Duration
+	// Answer DHCPINFORM from machines not in the book, too.
+	InformUnknownClients bool
+	// Behind DHCP relay agents. MyAddress is an address of the Interface,
+	// out of the Network.
+	Relayed bool
+}
+
+// AddressRange is inclusive.
+type AddressRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+func (r *AddressRange) Contains(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	return bytes.Compare(r.Start, ip) <= 0 && bytes.Compare(ip, r.End) <= 0
+}
+
+// HostNameSource tells where DHCP Host Name option comes from.
+type HostNameSource int
+
+const (
+	HostNameFromFQDN    HostNameSource = iota // The leftmost label of the FQDN of the interface.
+	HostNameFromMachine                       // The name of the machine.
+	HostNameNone                              // Never sent.
+)
+
+type V6Network struct {
+	Name              string
+	Interface         *net.Interface
+	Network           *net.IPNet
+	DHCP6Listen       string
+	NameServerAddrs   []net.IP
+	DomainSearch      []string
+	LeaseDurationDays float64
 }
 
 type Machine struct {
@@ -61,5 +276,13 @@ type Machine struct {
 type Interface struct {
 	HardwareAddr net.HardwareAddr
 	IPv4Addr     net.IP
-	Fqdn         string
+	IPv6Addr     net.IP        // nil if not assigned.
+	DUID         []byte        // nil if not assigned.
+	Fqdn         string        // for PTR. Empty if the interface has no name except wildcards.
+	Names        []string      // Fqdn and other names, including wildcards.
+	DHCP4Options []DHCP4Option // Overrides the options of the network.
+	Boot         *Boot         // Overrides the settings of the network. nil if not configured.
+	// Option 82 sub-options requests must come with. Empty if not restricted.
+	RelayCircuitID string
+	RelayRemoteID  string
 }
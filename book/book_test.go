@@ -0,0 +1,440 @@
+package book
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ledyba/disq/conf"
+	"github.com/miekg/dns"
+)
+
+func init() {
+	logrus.SetLevel(logrus.FatalLevel)
+}
+
+func machineHardwareAddr(i int) string {
+	return fmt.Sprintf("72:00:%02x:%02x:%02x:%02x", (i>>24)&0xff, (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+}
+
+func machineIPv4Addr(i int) string {
+	return fmt.Sprintf("10.%d.%d.%d", (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+}
+
+func machineFqdn(i int) string {
+	return fmt.Sprintf("m%d.eagle-jump.", i)
+}
+
+func makeBook(t testing.TB, n int) *Book {
+	c := &conf.Config{
+		Machines: make(map[string]conf.Machine),
+	}
+	for i := 0; i < n; i++ {
+		c.Machines[fmt.Sprintf("m%d", i)] = conf.Machine{
+			{
+				HardwareAddr: machineHardwareAddr(i),
+				IPv4Addr:     machineIPv4Addr(i),
+				Fqdn:         machineFqdn(i),
+			},
+		}
+	}
+	b, err := FromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLookup(t *testing.T) {
+	b := makeBook(t, 100)
+	for i := 0; i < 100; i++ {
+		expected := net.ParseIP(machineIPv4Addr(i))
+		hwaddr, _ := net.ParseMAC(machineHardwareAddr(i))
+		if ip := b.LookupIPForHardwareAddr(hwaddr); !expected.Equal(ip) {
+			t.Errorf("LookupIPForHardwareAddr(%s): expected %v, got %v", hwaddr, expected, ip)
+		}
+		if ip := b.LookupIPForFQDN(machineFqdn(i)); !expected.Equal(ip) {
+			t.Errorf("LookupIPForFQDN(%s): expected %v, got %v", machineFqdn(i), expected, ip)
+		}
+		if nic := b.LookupInterfaceForIP(expected); nic == nil || nic.Fqdn != machineFqdn(i) {
+			t.Errorf("LookupInterfaceForIP(%s): expected %s, got %v", expected, machineFqdn(i), nic)
+		}
+	}
+	hwaddr, _ := net.ParseMAC("72:ff:ff:ff:ff:ff")
+	if ip := b.LookupIPForHardwareAddr(hwaddr); ip != nil {
+		t.Errorf("Unknown hardware address resolved to %v", ip)
+	}
+	if ip := b.LookupIPForFQDN("nosuch.eagle-jump."); ip != nil {
+		t.Errorf("Unknown fqdn resolved to %v", ip)
+	}
+	if nic := b.LookupInterfaceForIP(net.IPv4(192, 168, 0, 1)); nic != nil {
+		t.Errorf("Unknown address resolved to %v", nic)
+	}
+}
+
+var benchmarkSizes = []int{10, 100, 1000, 10000}
+
+func BenchmarkLookupIPForHardwareAddr(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		bk := makeBook(b, n)
+		hwaddr, _ := net.ParseMAC(machineHardwareAddr(n - 1))
+		b.Run(fmt.Sprintf("machines=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if bk.LookupIPForHardwareAddr(hwaddr) == nil {
+					b.Fatal("not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLookupIPForFQDN(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		bk := makeBook(b, n)
+		fqdn := machineFqdn(n - 1)
+		b.Run(fmt.Sprintf("machines=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if bk.LookupIPForFQDN(fqdn) == nil {
+					b.Fatal("not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLookupInterfaceForIP(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		bk := makeBook(b, n)
+		ip := net.ParseIP(machineIPv4Addr(n - 1))
+		b.Run(fmt.Sprintf("machines=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if bk.LookupInterfaceForIP(ip) == nil {
+					b.Fatal("not found")
+				}
+			}
+		})
+	}
+}
+
+func TestDuplicatedIPv6Addr(t *testing.T) {
+	c := &conf.Config{
+		Machines: map[string]conf.Machine{
+			"aoba": {{
+				HardwareAddr: machineHardwareAddr(1),
+				IPv4Addr:     machineIPv4Addr(1),
+				IPv6Addr:     "fd00::1",
+			}},
+			"yagami": {{
+				HardwareAddr: machineHardwareAddr(2),
+				IPv4Addr:     machineIPv4Addr(2),
+				IPv6Addr:     "fd00:0::1",
+			}},
+		},
+	}
+	if _, err := FromConfig(c); err == nil {
+		t.Error("Duplicated IPv6 address must be rejected")
+	}
+	c.Machines["yagami"][0].IPv6Addr = "10.0.0.1"
+	if _, err := FromConfig(c); err == nil {
+		t.Error("IPv4 address in ipv6-address must be rejected")
+	}
+	c.Machines["yagami"][0].IPv6Addr = "fd00::2"
+	b, err := FromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nic := b.LookupInterfaceForIP(net.ParseIP("fd00::2")); nic == nil || nic.HardwareAddr.String() != machineHardwareAddr(2) {
+		t.Errorf("LookupInterfaceForIP(fd00::2): got %v", nic)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	makeConfig := func(records ...conf.Record) *conf.Config {
+		return &conf.Config{
+			DNS: conf.DNS{
+				LocalTTL: 600,
+				Zones: []conf.Zone{{
+					Name:        "eagle-jump.",
+					NameServers: []string{machineFqdn(1)},
+				}},
+			},
+			Machines: map[string]conf.Machine{
+				"m1": {{
+					HardwareAddr: machineHardwareAddr(1),
+					IPv4Addr:     machineIPv4Addr(1),
+					Fqdn:         machineFqdn(1),
+				}},
+			},
+			Records: records,
+		}
+	}
+
+	b, err := FromConfig(makeConfig(
+		conf.Record{Name: "db.eagle-jump.", Type: "CNAME", Target: machineFqdn(1)},
+		conf.Record{Name: "eagle-jump.", Type: "mx", Preference: 10, Target: machineFqdn(1)},
+		conf.Record{Name: "_ssh._tcp.eagle-jump", Type: "SRV", Port: 22, Target: machineFqdn(1)},
+		conf.Record{Name: "eagle-jump.", Type: "TXT", TTL: 60, Text: []string{"hello"}},
+		conf.Record{Name: "www.example.com.", Type: "CNAME", Target: "nosuch.example.com."},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cname := b.LookupCNAME("db.eagle-jump."); cname == nil || cname.Target != machineFqdn(1) || cname.Hdr.Ttl != 600 {
+		t.Errorf("Unexpected CNAME: %v", cname)
+	}
+	if rrs := b.LookupRecords("eagle-jump.", dns.TypeMX); len(rrs) != 1 {
+		t.Errorf("Unexpected MX: %v", rrs)
+	}
+	if rrs := b.LookupRecords("_ssh._tcp.eagle-jump.", dns.TypeSRV); len(rrs) != 1 || rrs[0].(*dns.SRV).Port != 22 {
+		t.Errorf("Unexpected SRV: %v", rrs)
+	}
+	if rrs := b.LookupRecords("eagle-jump.", dns.TypeTXT); len(rrs) != 1 || rrs[0].Header().Ttl != 60 {
+		t.Errorf("Unexpected TXT: %v", rrs)
+	}
+	if !b.NameExists("_tcp.eagle-jump.") {
+		t.Errorf("Ancestors of records must exist")
+	}
+
+	invalids := map[string][]conf.Record{
+		"unknown type":     {{Name: "a.eagle-jump.", Type: "HINFO"}},
+		"TXT without text": {{Name: "a.eagle-jump.", Type: "TXT"}},
+		"CNAME with A":     {{Name: machineFqdn(1), Type: "CNAME", Target: "db.example.com."}},
+		"CNAME with TXT":   {{Name: "a.eagle-jump.", Type: "CNAME", Target: machineFqdn(1)}, {Name: "a.eagle-jump.", Type: "TXT", Text: []string{"a"}}},
+		"CNAME at apex":    {{Name: "eagle-jump.", Type: "CNAME", Target: machineFqdn(1)}},
+		"dangling target":  {{Name: "a.eagle-jump.", Type: "MX", Target: "nosuch.eagle-jump."}},
+		"loop":             {{Name: "a.eagle-jump.", Type: "CNAME", Target: "b.eagle-jump."}, {Name: "b.eagle-jump.", Type: "CNAME", Target: "a.eagle-jump."}},
+		"invalid target":   {{Name: "a.eagle-jump.", Type: "CNAME", Target: ""}},
+	}
+	for name, records := range invalids {
+		if _, err := FromConfig(makeConfig(records...)); err == nil {
+			t.Errorf("%s must be rejected", name)
+		}
+	}
+}
+
+func TestZoneSerial(t *testing.T) {
+	modTime := time.Date(2017, 4, 1, 9, 0, 0, 0, time.UTC)
+	c := &conf.Config{
+		DNS: conf.DNS{
+			Zones: []conf.Zone{{
+				Name:        "eagle-jump.",
+				NameServers: []string{machineFqdn(1)},
+			}},
+		},
+		ModTime: modTime,
+	}
+	// Reloading the same config must not change the serial.
+	for i := 0; i < 2; i++ {
+		b, err := FromConfig(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial := b.DNS.Zones[0].Serial; serial != uint32(modTime.Unix()) {
+			t.Errorf("Expected the serial from the modification time, got %d", serial)
+		}
+	}
+	c.DNS.Zones[0].Serial = 42
+	b, err := FromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := b.DNS.Zones[0].Serial; serial != 42 {
+		t.Errorf("Expected the serial in the config, got %d", serial)
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	c := &conf.Config{
+		Machines: map[string]conf.Machine{
+			"ingress": {{
+				HardwareAddr: machineHardwareAddr(1),
+				IPv4Addr:     machineIPv4Addr(1),
+				Fqdns:        []string{"*.k8s.eagle-jump.", "ingress.eagle-jump."},
+			}},
+			"api": {{
+				HardwareAddr: machineHardwareAddr(2),
+				IPv4Addr:     machineIPv4Addr(2),
+				Fqdn:         "api.k8s.eagle-jump.",
+			}},
+			"etcd": {{
+				HardwareAddr: machineHardwareAddr(3),
+				IPv4Addr:     machineIPv4Addr(3),
+				Fqdn:         "a.etcd.k8s.eagle-jump.",
+			}},
+		},
+	}
+	b, err := FromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nic := b.LookupInterfaceForIP(net.ParseIP(machineIPv4Addr(1))); nic.Fqdn != "ingress.eagle-jump." {
+		t.Errorf("Wildcards must not be used for PTR, got %s", nic.Fqdn)
+	}
+	expected := map[string]string{
+		"api.k8s.eagle-jump.":    machineIPv4Addr(2), // Exact names first.
+		"web.k8s.eagle-jump.":    machineIPv4Addr(1),
+		"a.web.k8s.eagle-jump.":  machineIPv4Addr(1),
+		"*.k8s.eagle-jump.":      machineIPv4Addr(1),
+		"ingress.eagle-jump.":    machineIPv4Addr(1),
+		"etcd.k8s.eagle-jump.":   "", // Empty non-terminal.
+		"b.etcd.k8s.eagle-jump.": "", // The closest encloser is etcd.k8s.eagle-jump.
+		"k8s.eagle-jump.":        "",
+		"nosuch.eagle-jump.":     "",
+	}
+	for name, ip := range expected {
+		got := b.LookupIPForFQDN(name)
+		if (ip == "" && got != nil) || (ip != "" && !net.ParseIP(ip).Equal(got)) {
+			t.Errorf("LookupIPForFQDN(%s): expected %s, got %v", name, ip, got)
+		}
+	}
+
+	c.Machines["api"][0].Fqdns = []string{"k8s.*.eagle-jump."}
+	if _, err := FromConfig(c); err == nil {
+		t.Error("Wildcards not in the leftmost label must be rejected")
+	}
+}
+
+func TestSharedNames(t *testing.T) {
+	c := &conf.Config{
+		Machines: map[string]conf.Machine{
+			"m1": {{
+				HardwareAddr: machineHardwareAddr(1),
+				IPv4Addr:     machineIPv4Addr(1),
+				Fqdns:        []string{"api.eagle-jump."},
+			}},
+			"m2": {{
+				HardwareAddr: machineHardwareAddr(2),
+				IPv4Addr:     machineIPv4Addr(2),
+				Fqdns:        []string{"api.eagle-jump."},
+			}},
+		},
+	}
+	// Names shared between machines without declaration are only warned.
+	for _, shared := range [][]string{nil, {"api.eagle-jump."}} {
+		c.DNS.SharedNames = shared
+		b, err := FromConfig(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips := b.LookupIPsForFQDN("api.eagle-jump.")
+		if len(ips) != 2 || !ips[0].Equal(net.ParseIP(machineIPv4Addr(1))) || !ips[1].Equal(net.ParseIP(machineIPv4Addr(2))) {
+			t.Errorf("Expected all addresses in the order of machine names, got %v", ips)
+		}
+	}
+}
+
+func TestOverlappingNames(t *testing.T) {
+	c := &conf.Config{
+		Machines: map[string]conf.Machine{
+			"m1": {{
+				HardwareAddr: machineHardwareAddr(1),
+				IPv4Addr:     machineIPv4Addr(1),
+				Fqdns:        []string{"web.eagle-jump.", "*.k8s.eagle-jump."},
+			}, {
+				HardwareAddr: machineHardwareAddr(2),
+				IPv4Addr:     machineIPv4Addr(2),
+				Fqdns:        []string{"web.eagle-jump.", "*.k8s.eagle-jump."},
+			}},
+		},
+	}
+	if _, err := FromConfig(c); err == nil {
+		t.Error("Exact names overlapping between interfaces of a machine must be rejected")
+	}
+	c.DNS.SharedNames = []string{"web.eagle-jump."}
+	if _, err := FromConfig(c); err != nil {
+		t.Errorf("Shared names must be accepted: %v", err)
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	valids := map[string]string{
+		"Aoba.Eagle-Jump":       "aoba.eagle-jump.",
+		"aoba.eagle-jump.":      "aoba.eagle-jump.",
+		"*.K8S.eagle-jump.":     "*.k8s.eagle-jump.",
+		"_ldap._tcp.eagle-jump": "_ldap._tcp.eagle-jump.",
+	}
+	for name, expected := range valids {
+		if got, err := canonicalName(name); err != nil || got != expected {
+			t.Errorf("canonicalName(%s): expected %s, got %s (%v)", name, expected, got, err)
+		}
+	}
+	for _, name := range []string{"", ".", "aoba..eagle-jump.", "-aoba.eagle-jump.", "aoba-.eagle-jump.", "ao ba.eagle-jump.", "k8s.*.eagle-jump.", "*aoba.eagle-jump."} {
+		if got, err := canonicalName(name); err == nil {
+			t.Errorf("canonicalName(%q) must be rejected, got %s", name, got)
+		}
+	}
+
+	c := &conf.Config{
+		Machines: map[string]conf.Machine{
+			"aoba": {{
+				HardwareAddr: machineHardwareAddr(1),
+				IPv4Addr:     machineIPv4Addr(1),
+				Fqdn:         "Aoba.Eagle-Jump",
+			}},
+		},
+	}
+	b, err := FromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"aoba.eagle-jump.", "AOBA.eagle-jump.", "aOBa.EAGLE-JUMP."} {
+		if ip := b.LookupIPForFQDN(name); ip == nil {
+			t.Errorf("LookupIPForFQDN(%s) must ignore case", name)
+		}
+		if !b.NameExists(name) {
+			t.Errorf("NameExists(%s) must ignore case", name)
+		}
+	}
+
+	v6 := &conf.V6Network{
+		InterfaceName: "lo",
+		Network:       "fd00::/64",
+		DomainSearch:  []string{"Eagle-Jump", "K8S.eagle-jump."},
+	}
+	n, err := compileV6Network("v6", v6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.DomainSearch) != 2 || n.DomainSearch[0] != "eagle-jump." || n.DomainSearch[1] != "k8s.eagle-jump." {
+		t.Errorf("Domain search of v6 networks must be canonicalized, got %v", n.DomainSearch)
+	}
+	v6.DomainSearch = []string{"-eagle-jump."}
+	if _, err := compileV6Network("v6", v6); err == nil {
+		t.Error("Invalid domain search of v6 networks must be rejected")
+	}
+}
+
+func TestCompileAddressRange(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.0.0/24")
+	r, err := compileAddressRange(&conf.AddressRange{Start: "192.168.0.100", End: "192.168.0.199"}, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]bool{
+		"192.168.0.99":  false,
+		"192.168.0.100": true,
+		"192.168.0.150": true,
+		"192.168.0.199": true,
+		"192.168.0.200": false,
+		"::1":           false,
+	} {
+		if r.Contains(net.ParseIP(ip)) != expected {
+			t.Errorf("Contains(%s) must be %v", ip, expected)
+		}
+	}
+	if r, err := compileAddressRange(nil, network); r != nil || err != nil {
+		t.Errorf("Expected no range, got %v, %v", r, err)
+	}
+	for _, c := range []conf.AddressRange{
+		{Start: "192.168.0.200", End: "192.168.0.100"},
+		{Start: "192.168.0.100", End: "192.168.1.100"},
+		{Start: "192.168.0.100"},
+		{Start: "::1", End: "::2"},
+	} {
+		if _, err := compileAddressRange(&c, network); err == nil {
+			t.Errorf("Expected an error for %+v", c)
+		}
+	}
+}
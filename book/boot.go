@@ -0,0 +1,90 @@
+package book
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/ledyba/disq/conf"
+)
+
+// Boot is for network boot (PXE).
+type Boot struct {
+	NextServer net.IP // siaddr. nil if not configured.
+	ServerName string // TFTP server name (option 66)
+	File       string // Boot file name (option 67), for clients of unknown architectures.
+	// Boot file names by client system architecture (option 93).
+	Files map[uint16]string
+}
+
+// Client system architecture types. See RFC 4578 and
+// https://www.iana.org/assignments/dhcpv6-parameters/dhcpv6-parameters.xhtml#processor-architecture
+var bootArchs = map[string]uint16{
+	"bios":       0,
+	"efi-ia32":   6,
+	"efi-bc":     7,
+	"efi-x86-64": 9,
+	"efi-arm32":  10,
+	"efi-arm64":  11,
+}
+
+// BootFile returns the boot file name for the value of option 93,
+// or empty string if not configured.
+func (b *Boot) BootFile(arch []byte) string {
+	if len(arch) >= 2 {
+		if file, ok := b.Files[binary.BigEndian.Uint16(arch)]; ok {
+			return file
+		}
+	}
+	return b.File
+}
+
+func compileBoot(c *conf.Boot) (*Boot, error) {
+	if c == nil {
+		return nil, nil
+	}
+	b := &Boot{
+		ServerName: c.ServerName,
+		File:       c.File,
+		Files:      make(map[uint16]string),
+	}
+	if len(c.NextServer) > 0 {
+		b.NextServer = net.ParseIP(c.NextServer).To4()
+		if b.NextServer == nil {
+			return nil, &net.ParseError{
+				Type: "IP address",
+				Text: c.NextServer,
+			}
+		}
+	}
+	for name, file := range c.Files {
+		arch, ok := bootArchs[name]
+		if !ok {
+			code, err := strconv.ParseUint(name, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("unknown architecture for network boot: %s", name)
+			}
+			arch = uint16(code)
+		}
+		b.Files[arch] = file
+	}
+	// The file field of BOOTP is 128 bytes, and the sname field is 64 bytes.
+	for _, file := range append([]string{b.File}, valuesOf(b.Files)...) {
+		if len(file) >= 128 {
+			return nil, fmt.Errorf("boot file name is too long: %s", file)
+		}
+	}
+	if len(b.ServerName) >= 64 {
+		return nil, fmt.Errorf("boot server name is too long: %s", b.ServerName)
+	}
+	return b, nil
+}
+
+func valuesOf(m map[uint16]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,69 @@
+package book
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ledyba/disq/conf"
+)
+
+func TestCompileBoot(t *testing.T) {
+	b, err := compileBoot(&conf.Boot{
+		NextServer: "192.168.0.1",
+		File:       "pxelinux.0",
+		Files: map[string]string{
+			"efi-x86-64": "grubx64.efi",
+			"16":         "http.efi",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := b.BootFile(nil); file != "pxelinux.0" {
+		t.Errorf("Expected the default file, got %s", file)
+	}
+	if file := b.BootFile([]byte{0, 9}); file != "grubx64.efi" {
+		t.Errorf("Expected the file for UEFI x86-64, got %s", file)
+	}
+	if file := b.BootFile([]byte{0, 16}); file != "http.efi" {
+		t.Errorf("Expected the file for architecture 16, got %s", file)
+	}
+	if file := b.BootFile([]byte{0, 11}); file != "pxelinux.0" {
+		t.Errorf("Expected the default file for unknown architectures, got %s", file)
+	}
+
+	invalids := map[string]*conf.Boot{
+		"invalid next server":  {NextServer: "fd00::1"},
+		"unknown architecture": {Files: map[string]string{"m68k": "a"}},
+		"too long file":        {File: string(make([]byte, 128))},
+	}
+	for name, c := range invalids {
+		if _, err := compileBoot(c); err == nil {
+			t.Errorf("%s must be rejected", name)
+		}
+	}
+}
+
+func TestCompileTFTPRoot(t *testing.T) {
+	root, err := compileTFTPRoot(&conf.V4Network{TFTPListen: ":69", TFTPRoot: "."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(root) {
+		t.Errorf("Expected an absolute path, got %s", root)
+	}
+	if root, err := compileTFTPRoot(&conf.V4Network{}); err != nil || root != "" {
+		t.Errorf("Expected TFTP to be disabled, got %q, %v", root, err)
+	}
+	for _, c := range []conf.V4Network{
+		{TFTPRoot: "."},
+		{TFTPListen: ":69"},
+		{TFTPListen: "69", TFTPRoot: "."},
+		{TFTPListen: ":69", TFTPRoot: "boot_test.go"},
+		{TFTPListen: ":69", TFTPRoot: "not-found"},
+	} {
+		if _, err := compileTFTPRoot(&c); err == nil {
+			t.Errorf("Expected an error for %+v", c)
+		}
+	}
+}
@@ -1,19 +1,34 @@
 package book
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"fmt"
 
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/ledyba/disq/conf"
+	"github.com/miekg/dns"
 )
 
+const DefaultConflictCooldown = 10 * time.Minute
+
 var (
 	ErrAddressIsNotAssigned = errors.New("specified address is not assigned to the interface")
 )
 
+const (
+	defaultUpstreamTimeout = 2 * time.Second
+	resolvConfPath         = "/etc/resolv.conf"
+)
+
 func FromConfig(conf *conf.Config) (*Book, error) {
 	var err error
 	b := &Book{}
@@ -30,11 +45,70 @@ func FromConfig(conf *conf.Config) (*Book, error) {
 		b.DNS.GlobalTTL = 0
 	}
 	for _, network := range b.DNS.Networks {
-		_, ok := conf.V4Networks[network]
-		if !ok {
+		_, ok4 := conf.V4Networks[network]
+		_, ok6 := conf.V6Networks[network]
+		if !ok4 && !ok6 {
 			return nil, fmt.Errorf("network [%s] (allowed for serving DNS) not found", network)
 		}
 	}
+	b.DNS.Upstreams, err = compileUpstreams(conf.DNS.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	for _, proxy := range conf.DNS.ClientSubnetProxies {
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Errorf("Client subnet proxy %s is not a valid network.", proxy)
+			return nil, err
+		}
+		b.DNS.ClientSubnetProxies = append(b.DNS.ClientSubnetProxies, network)
+	}
+	for _, name := range conf.DNS.SharedNames {
+		name, err := canonicalName(name)
+		if err != nil {
+			return nil, fmt.Errorf("shared name is invalid: %v", err)
+		}
+		b.DNS.SharedNames = append(b.DNS.SharedNames, name)
+	}
+	b.DNS.UpstreamTimeout = time.Duration(float64(time.Second) * conf.DNS.UpstreamTimeoutSeconds)
+	if b.DNS.UpstreamTimeout <= 0 {
+		b.DNS.UpstreamTimeout = defaultUpstreamTimeout
+	}
+	b.DNS.Cache = DNSCache{
+		MaxEntries: conf.DNS.Cache.MaxEntries,
+		MinTTL:     conf.DNS.Cache.MinTTL,
+		MaxTTL:     conf.DNS.Cache.MaxTTL,
+	}
+	if b.DNS.Cache.MaxEntries < 0 {
+		b.DNS.Cache.MaxEntries = 0
+	}
+	if b.DNS.Cache.MinTTL < 0 {
+		b.DNS.Cache.MinTTL = 0
+	}
+	if b.DNS.Cache.MaxTTL < 0 {
+		b.DNS.Cache.MaxTTL = 0
+	}
+	if b.DNS.Cache.MaxTTL > 0 && b.DNS.Cache.MinTTL > b.DNS.Cache.MaxTTL {
+		return nil, fmt.Errorf("min-ttl(%d) of DNS cache is larger than max-ttl(%d)", b.DNS.Cache.MinTTL, b.DNS.Cache.MaxTTL)
+	}
+
+	// Zones
+	for _, zoneConf := range conf.DNS.Zones {
+		zone, err := compileZone(&zoneConf, conf.ModTime)
+		if err != nil {
+			return nil, err
+		}
+		b.DNS.Zones = append(b.DNS.Zones, zone)
+	}
+
+	// Records
+	for _, recordConf := range conf.Records {
+		rr, err := compileRecord(&recordConf, b.DNS.LocalTTL)
+		if err != nil {
+			return nil, err
+		}
+		b.Records = append(b.Records, rr)
+	}
 
 	// V4Netrowks
 	b.V4Networks = make(map[string]*V4Network)
@@ -43,9 +117,20 @@ func FromConfig(conf *conf.Config) (*Book, error) {
 		if err != nil {
 			return nil, err
 		}
+		network.Name = name
 		b.V4Networks[name] = network
 	}
 
+	// V6Networks
+	b.V6Networks = make(map[string]*V6Network)
+	for name, netConf := range conf.V6Networks {
+		network, err := compileV6Network(name, &netConf)
+		if err != nil {
+			return nil, err
+		}
+		b.V6Networks[name] = network
+	}
+
 	// Machines
 	b.Machines = make(map[string]*Machine)
 	for name, mc := range conf.Machines {
@@ -60,10 +145,174 @@ func FromConfig(conf *conf.Config) (*Book, error) {
 	if err != nil {
 		return nil, err
 	}
+	b.buildIndex()
 
 	return b, nil
 }
 
+func compileUpstreams(upstreams []string) ([]string, error) {
+	if len(upstreams) == 0 {
+		// Use the same servers as the host resolver does.
+		cc, err := dns.ClientConfigFromFile(resolvConfPath)
+		if err != nil {
+			log.Warnf("Upstream DNS servers are not configured, and failed to read %s: %v", resolvConfPath, err)
+			return nil, nil
+		}
+		log.Infof("Upstream DNS servers are not configured. Using %v from %s", cc.Servers, resolvConfPath)
+		addrs := make([]string, len(cc.Servers))
+		for i, server := range cc.Servers {
+			addrs[i] = net.JoinHostPort(server, cc.Port)
+		}
+		return addrs, nil
+	}
+	addrs := make([]string, len(upstreams))
+	for i, upstream := range upstreams {
+		host, port, err := net.SplitHostPort(upstream)
+		if err != nil {
+			host, port = upstream, "53"
+		}
+		if net.ParseIP(host) == nil {
+			log.Errorf("Upstream %s is not a valid address.", upstream)
+			return nil, &net.ParseError{
+				Type: "IP address",
+				Text: upstream,
+			}
+		}
+		addrs[i] = net.JoinHostPort(host, port)
+	}
+	return addrs, nil
+}
+
+// canonicalName makes the name lowercase and fully qualified.
+// Labels must consist of letters, digits, hyphens and underscores (for SRV).
+// Only the leftmost label can be a wildcard.
+func canonicalName(name string) (string, error) {
+	if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 || name == "." {
+		return "", fmt.Errorf("%s is not a valid domain name", name)
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	for i, label := range dns.SplitDomainName(name) {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("label %s of %s starts or ends with a hyphen", label, name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+				return "", fmt.Errorf("label %s of %s has an invalid character: %q", label, name, c)
+			}
+		}
+	}
+	return name, nil
+}
+
+func compileZone(c *conf.Zone, modTime time.Time) (*Zone, error) {
+	name, err := canonicalName(c.Name)
+	if err != nil {
+		return nil, fmt.Errorf("zone name is invalid: %v", err)
+	}
+	z := &Zone{
+		Name:        name,
+		Hostmaster:  c.Hostmaster,
+		Serial:      c.Serial,
+		Refresh:     c.Refresh,
+		Retry:       c.Retry,
+		Expire:      c.Expire,
+		NegativeTTL: c.NegativeTTL,
+	}
+	if len(c.NameServers) == 0 {
+		return nil, fmt.Errorf("no nameservers are configured for zone %s", z.Name)
+	}
+	for _, ns := range c.NameServers {
+		ns, err := canonicalName(ns)
+		if err != nil {
+			return nil, fmt.Errorf("nameserver for zone %s is invalid: %v", z.Name, err)
+		}
+		z.NameServers = append(z.NameServers, ns)
+	}
+	if len(z.Hostmaster) == 0 {
+		z.Hostmaster = "hostmaster." + z.Name
+	}
+	if _, ok := dns.IsDomainName(z.Hostmaster); !ok {
+		return nil, fmt.Errorf("hostmaster %s (for zone %s) is not a valid domain name", z.Hostmaster, z.Name)
+	}
+	z.Hostmaster = dns.Fqdn(z.Hostmaster)
+	// The serial changes only when the config is modified,
+	// so that secondaries don't transfer the zone on every reload.
+	if z.Serial == 0 && !modTime.IsZero() {
+		z.Serial = uint32(modTime.Unix())
+	}
+	if z.Serial == 0 {
+		z.Serial = 1
+	}
+	if z.Refresh == 0 {
+		z.Refresh = 3600
+	}
+	if z.Retry == 0 {
+		z.Retry = 600
+	}
+	if z.Expire == 0 {
+		z.Expire = 604800
+	}
+	if z.NegativeTTL == 0 {
+		z.NegativeTTL = 60
+	}
+	return z, nil
+}
+
+func compileRecord(c *conf.Record, defaultTTL int) (dns.RR, error) {
+	name, err := canonicalName(c.Name)
+	if err != nil {
+		return nil, fmt.Errorf("record name is invalid: %v", err)
+	}
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	hdr := dns.RR_Header{
+		Name:  name,
+		Class: dns.ClassINET,
+		Ttl:   uint32(ttl),
+	}
+	typ := strings.ToUpper(c.Type)
+	target := c.Target
+	switch typ {
+	case "CNAME", "MX", "SRV":
+		if typ != "CNAME" && target == "." {
+			// "." means no service. See RFC 2782 and RFC 7505.
+			break
+		}
+		target, err = canonicalName(target)
+		if err != nil {
+			return nil, fmt.Errorf("target of %s record %s is invalid: %v", typ, hdr.Name, err)
+		}
+	}
+	switch typ {
+	case "CNAME":
+		hdr.Rrtype = dns.TypeCNAME
+		return &dns.CNAME{Hdr: hdr, Target: target}, nil
+	case "MX":
+		hdr.Rrtype = dns.TypeMX
+		return &dns.MX{Hdr: hdr, Preference: c.Preference, Mx: target}, nil
+	case "SRV":
+		hdr.Rrtype = dns.TypeSRV
+		return &dns.SRV{Hdr: hdr, Priority: c.Priority, Weight: c.Weight, Port: c.Port, Target: target}, nil
+	case "TXT":
+		if len(c.Text) == 0 {
+			return nil, fmt.Errorf("TXT record %s has no text", hdr.Name)
+		}
+		for _, txt := range c.Text {
+			if len(txt) > 255 {
+				return nil, fmt.Errorf("text of TXT record %s is longer than 255 bytes", hdr.Name)
+			}
+		}
+		hdr.Rrtype = dns.TypeTXT
+		return &dns.TXT{Hdr: hdr, Txt: c.Text}, nil
+	}
+	return nil, fmt.Errorf("type %s of record %s is not supported", c.Type, hdr.Name)
+}
+
 func compileMachine(name string, c *conf.Machine) (*Machine, error) {
 	infs := make([]Interface, len(*c))
 	for i, inf := range *c {
@@ -81,10 +330,60 @@ func compileMachine(name string, c *conf.Machine) (*Machine, error) {
 				Text: inf.IPv4Addr,
 			}
 		}
+		var ipv6addr net.IP
+		if len(inf.IPv6Addr) > 0 {
+			ipv6addr = net.ParseIP(inf.IPv6Addr)
+			if ipv6addr == nil || ipv6addr.To4() != nil {
+				return nil, &net.ParseError{
+					Type: "IPv6 address",
+					Text: inf.IPv6Addr,
+				}
+			}
+		}
+		var duid []byte
+		if len(inf.DUID) > 0 {
+			duid, err = hex.DecodeString(strings.Replace(inf.DUID, ":", "", -1))
+			if err != nil || len(duid) == 0 {
+				return nil, &net.ParseError{
+					Type: "DUID",
+					Text: inf.DUID,
+				}
+			}
+		}
+		var names []string
+		var fqdn string
+		for _, n := range append([]string{inf.Fqdn}, inf.Fqdns...) {
+			if len(n) == 0 {
+				continue
+			}
+			n, err = canonicalName(n)
+			if err != nil {
+				return nil, fmt.Errorf("name of %s is invalid: %v", name, err)
+			}
+			if len(fqdn) == 0 && !strings.HasPrefix(n, "*.") {
+				fqdn = n
+			}
+			names = append(names, n)
+		}
+		dhcp4Options, err := compileDHCP4Options(inf.DHCP4Options)
+		if err != nil {
+			return nil, fmt.Errorf("DHCP options of %s are invalid: %v", name, err)
+		}
+		boot, err := compileBoot(inf.Boot)
+		if err != nil {
+			return nil, fmt.Errorf("boot settings of %s are invalid: %v", name, err)
+		}
 		infs[i] = Interface{
-			HardwareAddr: hwaddr,
-			IPv4Addr:     ipv4addr,
-			Fqdn:         inf.Fqdn,
+			HardwareAddr:   hwaddr,
+			IPv4Addr:       ipv4addr,
+			IPv6Addr:       ipv6addr,
+			DUID:           duid,
+			Fqdn:           fqdn,
+			Names:          names,
+			DHCP4Options:   dhcp4Options,
+			Boot:           boot,
+			RelayCircuitID: inf.RelayCircuitID,
+			RelayRemoteID:  inf.RelayRemoteID,
 		}
 	}
 	return &Machine{
@@ -145,6 +444,13 @@ func compileNetwork(netConf *conf.V4Network) (*V4Network, error) {
 			addr = ip
 			break
 		}
+		// Replies to relay agents are sent from the interface.
+		if netConf.Relayed && addr == nil && ip.To4() != nil {
+			addr = ip.To4()
+		}
+	}
+	if netConf.Relayed && len(netConf.DHCP4Listen) > 0 {
+		return nil, fmt.Errorf("relayed network %s can't have dhcp4-listen: it is served by the network of %s", netConf.Network, netConf.InterfaceName)
 	}
 
 	if addr == nil {
@@ -190,14 +496,202 @@ func compileNetwork(netConf *conf.V4Network) (*V4Network, error) {
 			}
 		}
 	}
+	var hostName HostNameSource
+	switch netConf.HostName {
+	case "", "fqdn":
+		hostName = HostNameFromFQDN
+	case "machine":
+		hostName = HostNameFromMachine
+	case "none":
+		hostName = HostNameNone
+	default:
+		log.Errorf("HostName %s (configured for %s) must be one of fqdn, machine or none.", netConf.HostName, netConf.InterfaceName)
+		return nil, fmt.Errorf("invalid host-name: %s", netConf.HostName)
+	}
+
+	var domainName string
+	if len(netConf.DomainName) > 0 {
+		domainName, err = canonicalName(netConf.DomainName)
+		if err != nil {
+			log.Errorf("DomainName %s (configured for %s) is not a valid domain name.", netConf.DomainName, netConf.InterfaceName)
+			return nil, err
+		}
+	}
+
+	var domainSearch []string
+	size := 0
+	for _, domain := range netConf.DomainSearch {
+		name, err := canonicalName(domain)
+		if err != nil {
+			log.Errorf("Domain %s (configured for %s) is not a valid domain name.", domain, netConf.InterfaceName)
+			return nil, err
+		}
+		domainSearch = append(domainSearch, name)
+		size += len(name) + 1
+	}
+	if size > 255 {
+		// Long options (RFC 3396) are not supported.
+		return nil, fmt.Errorf("domain-search (configured for %s) is too long: %d bytes", netConf.InterfaceName, size)
+	}
+
+	dhcp4Options, err := compileDHCP4Options(netConf.DHCP4Options)
+	if err != nil {
+		log.Errorf("DHCP4Options (configured for %s) are invalid.", netConf.InterfaceName)
+		return nil, err
+	}
+
+	boot, err := compileBoot(netConf.Boot)
+	if err != nil {
+		log.Errorf("Boot (configured for %s) is invalid.", netConf.InterfaceName)
+		return nil, err
+	}
+
+	tftpRoot, err := compileTFTPRoot(netConf)
+	if err != nil {
+		log.Errorf("TFTP (configured for %s) is invalid.", netConf.InterfaceName)
+		return nil, err
+	}
+
+	dynamicRange, err := compileAddressRange(netConf.DynamicRange, network)
+	if err != nil {
+		log.Errorf("DynamicRange (configured for %s) is invalid.", netConf.InterfaceName)
+		return nil, err
+	}
+
+	conflictCooldown := DefaultConflictCooldown
+	if netConf.ConflictCooldownMinutes < 0 {
+		return nil, fmt.Errorf("conflict-cooldown-minutes (configured for %s) is negative: %v", netConf.InterfaceName, netConf.ConflictCooldownMinutes)
+	} else if netConf.ConflictCooldownMinutes > 0 {
+		conflictCooldown = time.Duration(netConf.ConflictCooldownMinutes * float64(time.Minute))
+	}
+
 	return &V4Network{
+		Interface:            nif,
+		MyAddress:            addr,
+		Network:              network,
+		DHCP4Listen:          netConf.DHCP4Listen,
+		NameServerAddrs:      nameServerAddrs,
+		GatewayAddr:          gatewayAddress,
+		LeaseDurationDays:    netConf.LeaseDurationDays,
+		HostName:             hostName,
+		DomainName:           domainName,
+		DomainSearch:         domainSearch,
+		DHCP4Options:         dhcp4Options,
+		Boot:                 boot,
+		TFTPListen:           netConf.TFTPListen,
+		TFTPRoot:             tftpRoot,
+		DynamicRange:         dynamicRange,
+		Probe:                netConf.Probe,
+		ConflictCooldown:     conflictCooldown,
+		InformUnknownClients: netConf.InformUnknownClients,
+		Relayed:              netConf.Relayed,
+	}, nil
+
+}
+
+func compileAddressRange(c *conf.AddressRange, network *net.IPNet) (*AddressRange, error) {
+	if c == nil {
+		return nil, nil
+	}
+	start := net.ParseIP(c.Start).To4()
+	end := net.ParseIP(c.End).To4()
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("invalid address range: %s - %s", c.Start, c.End)
+	}
+	if !network.Contains(start) || !network.Contains(end) {
+		return nil, fmt.Errorf("address range %s - %s is not in the network %s", start, end, network)
+	}
+	if bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("start of address range %s - %s is after its end", start, end)
+	}
+	return &AddressRange{
+		Start: start,
+		End:   end,
+	}, nil
+}
+
+// compileTFTPRoot returns the absolute path of tftp-root,
+// or empty if TFTP server is disabled.
+func compileTFTPRoot(netConf *conf.V4Network) (string, error) {
+	if len(netConf.TFTPListen) == 0 {
+		if len(netConf.TFTPRoot) > 0 {
+			return "", fmt.Errorf("tftp-root is configured, but tftp-listen is not")
+		}
+		return "", nil
+	}
+	if _, _, err := net.SplitHostPort(netConf.TFTPListen); err != nil {
+		return "", fmt.Errorf("invalid tftp-listen: %v", err)
+	}
+	if len(netConf.TFTPRoot) == 0 {
+		return "", fmt.Errorf("tftp-root is not configured")
+	}
+	root, err := filepath.Abs(netConf.TFTPRoot)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("tftp-root %s is not a directory", root)
+	}
+	return root, nil
+}
+
+func compileV6Network(name string, netConf *conf.V6Network) (*V6Network, error) {
+	nif, err := net.InterfaceByName(netConf.InterfaceName)
+	if err != nil {
+		log.Errorf("Interface %s (configured for %s) not found", netConf.InterfaceName, name)
+		return nil, err
+	}
+
+	_, network, err := net.ParseCIDR(netConf.Network)
+	if err == nil && network.IP.To4() != nil {
+		err = &net.ParseError{
+			Type: "IPv6 network",
+			Text: netConf.Network,
+		}
+	}
+	if err != nil {
+		log.Errorf("NetworkAddress %s (configured for %s) is not a valid ipv6 network.", netConf.Network, netConf.InterfaceName)
+		return nil, err
+	}
+
+	var nameServerAddrs []net.IP
+	if len(netConf.NameServerAddrs) == 0 {
+		log.Warnf("NameServerAddress is not configured for %s", netConf.InterfaceName)
+	} else {
+		for _, addr := range netConf.NameServerAddrs {
+			ip := net.ParseIP(addr)
+			if ip == nil || ip.To4() != nil {
+				log.Errorf("NameServer %s (configured for %s) is not a valid ipv6 address.", addr, netConf.InterfaceName)
+				return nil, &net.ParseError{
+					Type: "IPv6 address",
+					Text: addr,
+				}
+			}
+			nameServerAddrs = append(nameServerAddrs, ip)
+		}
+	}
+
+	var domainSearch []string
+	for _, domain := range netConf.DomainSearch {
+		name, err := canonicalName(domain)
+		if err != nil {
+			log.Errorf("Domain %s (configured for %s) is not a valid domain name.", domain, netConf.InterfaceName)
+			return nil, err
+		}
+		domainSearch = append(domainSearch, name)
+	}
+
+	return &V6Network{
+		Name:              name,
 		Interface:         nif,
-		MyAddress:         addr,
 		Network:           network,
-		DHCP4Listen:       netConf.DHCP4Listen,
+		DHCP6Listen:       netConf.DHCP6Listen,
 		NameServerAddrs:   nameServerAddrs,
-		GatewayAddr:       gatewayAddress,
+		DomainSearch:      domainSearch,
 		LeaseDurationDays: netConf.LeaseDurationDays,
 	}, nil
-
 }
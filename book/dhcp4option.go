@@ -0,0 +1,217 @@
+package book
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ledyba/disq/conf"
+)
+
+// DHCP4Option is an encoded option, ready to be sent.
+type DHCP4Option struct {
+	Code  byte
+	Value []byte
+}
+
+type dhcp4OptionType int
+
+const (
+	dhcp4OptionIPs dhcp4OptionType = iota
+	dhcp4OptionString
+	dhcp4OptionUint8
+	dhcp4OptionUint16
+	dhcp4OptionUint32
+	dhcp4OptionHex
+	dhcp4OptionRoutes
+)
+
+type dhcp4OptionSpec struct {
+	code byte
+	typ  dhcp4OptionType
+}
+
+// See RFC 2132, RFC 3442 and https://www.iana.org/assignments/bootp-dhcp-parameters
+var dhcp4OptionSpecs = map[string]dhcp4OptionSpec{
+	"router":                  {3, dhcp4OptionIPs},
+	"time-servers":            {4, dhcp4OptionIPs},
+	"domain-name-servers":     {6, dhcp4OptionIPs},
+	"log-servers":             {7, dhcp4OptionIPs},
+	"host-name":               {12, dhcp4OptionString},
+	"domain-name":             {15, dhcp4OptionString},
+	"default-ip-ttl":          {23, dhcp4OptionUint8},
+	"interface-mtu":           {26, dhcp4OptionUint16},
+	"broadcast-address":       {28, dhcp4OptionIPs},
+	"nis-domain":              {40, dhcp4OptionString},
+	"nis-servers":             {41, dhcp4OptionIPs},
+	"ntp-servers":             {42, dhcp4OptionIPs},
+	"vendor-specific":         {43, dhcp4OptionHex},
+	"netbios-name-servers":    {44, dhcp4OptionIPs},
+	"renewal-time":            {58, dhcp4OptionUint32},
+	"rebinding-time":          {59, dhcp4OptionUint32},
+	"tftp-server-name":        {66, dhcp4OptionString},
+	"bootfile-name":           {67, dhcp4OptionString},
+	"classless-static-routes": {121, dhcp4OptionRoutes},
+}
+
+// Options which are managed by the protocol itself.
+var reservedDHCP4Options = map[byte]bool{
+	0:   true, // Pad
+	50:  true, // Requested IP Address
+	51:  true, // IP Address Lease Time
+	52:  true, // Option Overload
+	53:  true, // DHCP Message Type
+	54:  true, // Server Identifier
+	55:  true, // Parameter Request List
+	57:  true, // Maximum DHCP Message Size
+	61:  true, // Client Identifier
+	255: true, // End
+}
+
+func compileDHCP4Options(confs []conf.DHCP4Option) ([]DHCP4Option, error) {
+	var opts []DHCP4Option
+	for _, c := range confs {
+		opt, err := compileDHCP4Option(&c)
+		if err != nil {
+			return nil, err
+		}
+		for _, another := range opts {
+			if another.Code == opt.Code {
+				return nil, fmt.Errorf("DHCP option %d is configured twice", opt.Code)
+			}
+		}
+		opts = append(opts, *opt)
+	}
+	return opts, nil
+}
+
+func compileDHCP4Option(c *conf.DHCP4Option) (*DHCP4Option, error) {
+	// Which value is set?
+	var typ dhcp4OptionType
+	cnt := 0
+	if len(c.IPs) > 0 {
+		typ, cnt = dhcp4OptionIPs, cnt+1
+	}
+	if len(c.String) > 0 {
+		typ, cnt = dhcp4OptionString, cnt+1
+	}
+	if c.Uint != nil {
+		typ, cnt = dhcp4OptionUint32, cnt+1
+	}
+	if len(c.Hex) > 0 {
+		typ, cnt = dhcp4OptionHex, cnt+1
+	}
+	if len(c.Routes) > 0 {
+		typ, cnt = dhcp4OptionRoutes, cnt+1
+	}
+
+	var code byte
+	if len(c.Name) > 0 {
+		spec, ok := dhcp4OptionSpecs[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown DHCP option: %s", c.Name)
+		}
+		if c.Code != 0 && c.Code != int(spec.code) {
+			return nil, fmt.Errorf("DHCP option %s is %d, but configured as %d", c.Name, spec.code, c.Code)
+		}
+		code = spec.code
+		// Options with uint values have their own sizes.
+		if typ == dhcp4OptionUint32 && (spec.typ == dhcp4OptionUint8 || spec.typ == dhcp4OptionUint16) {
+			typ = spec.typ
+		}
+		if cnt == 1 && typ != spec.typ {
+			return nil, fmt.Errorf("DHCP option %s has a value of wrong type", c.Name)
+		}
+	} else {
+		if c.Code <= 0 || c.Code > 255 {
+			return nil, fmt.Errorf("DHCP option needs name or code (1-254): %d", c.Code)
+		}
+		code = byte(c.Code)
+	}
+	if reservedDHCP4Options[code] {
+		return nil, fmt.Errorf("DHCP option %d can't be configured", code)
+	}
+	if cnt != 1 {
+		return nil, fmt.Errorf("DHCP option %d must have exactly one value", code)
+	}
+
+	var value []byte
+	switch typ {
+	case dhcp4OptionIPs:
+		for _, addr := range c.IPs {
+			ip := net.ParseIP(addr).To4()
+			if ip == nil {
+				return nil, &net.ParseError{
+					Type: "IP address",
+					Text: addr,
+				}
+			}
+			value = append(value, ip...)
+		}
+	case dhcp4OptionString:
+		value = []byte(c.String)
+	case dhcp4OptionUint8:
+		if *c.Uint > 0xff {
+			return nil, fmt.Errorf("value of DHCP option %d is too large: %d", code, *c.Uint)
+		}
+		value = []byte{byte(*c.Uint)}
+	case dhcp4OptionUint16:
+		if *c.Uint > 0xffff {
+			return nil, fmt.Errorf("value of DHCP option %d is too large: %d", code, *c.Uint)
+		}
+		value = make([]byte, 2)
+		binary.BigEndian.PutUint16(value, uint16(*c.Uint))
+	case dhcp4OptionUint32:
+		value = make([]byte, 4)
+		binary.BigEndian.PutUint32(value, *c.Uint)
+	case dhcp4OptionHex:
+		var err error
+		value, err = hex.DecodeString(strings.Replace(c.Hex, ":", "", -1))
+		if err != nil {
+			return nil, &net.ParseError{
+				Type: "hex",
+				Text: c.Hex,
+			}
+		}
+	case dhcp4OptionRoutes:
+		for _, route := range c.Routes {
+			b, err := encodeClasslessRoute(&route)
+			if err != nil {
+				return nil, err
+			}
+			value = append(value, b...)
+		}
+	}
+	if len(value) > 255 {
+		// Long options (RFC 3396) are not supported.
+		return nil, fmt.Errorf("value of DHCP option %d is too long: %d bytes", code, len(value))
+	}
+	return &DHCP4Option{
+		Code:  code,
+		Value: value,
+	}, nil
+}
+
+// See RFC 3442
+func encodeClasslessRoute(route *conf.DHCP4Route) ([]byte, error) {
+	_, dest, err := net.ParseCIDR(route.Destination)
+	if err != nil || dest.IP.To4() == nil {
+		return nil, &net.ParseError{
+			Type: "IPv4 network",
+			Text: route.Destination,
+		}
+	}
+	router := net.ParseIP(route.Router).To4()
+	if router == nil {
+		return nil, &net.ParseError{
+			Type: "IP address",
+			Text: route.Router,
+		}
+	}
+	width, _ := dest.Mask.Size()
+	b := []byte{byte(width)}
+	b = append(b, dest.IP.To4()[:(width+7)/8]...)
+	return append(b, router...), nil
+}
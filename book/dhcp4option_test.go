@@ -0,0 +1,67 @@
+package book
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledyba/disq/conf"
+)
+
+func TestCompileDHCP4Options(t *testing.T) {
+	mtu := uint32(9000)
+	ttl := uint32(64)
+	opts, err := compileDHCP4Options([]conf.DHCP4Option{
+		{Name: "ntp-servers", IPs: []string{"192.168.0.1", "192.168.0.2"}},
+		{Name: "interface-mtu", Uint: &mtu},
+		{Name: "default-ip-ttl", Uint: &ttl},
+		{Name: "vendor-specific", Hex: "01:02:ff"},
+		{Code: 252, String: "http://wpad.eagle-jump/wpad.dat"},
+		{Name: "classless-static-routes", Routes: []conf.DHCP4Route{
+			{Destination: "10.0.0.0/8", Router: "192.168.0.1"},
+			{Destination: "0.0.0.0/0", Router: "192.168.0.254"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DHCP4Option{
+		{42, []byte{192, 168, 0, 1, 192, 168, 0, 2}},
+		{26, []byte{0x23, 0x28}},
+		{23, []byte{64}},
+		{43, []byte{1, 2, 0xff}},
+		{252, []byte("http://wpad.eagle-jump/wpad.dat")},
+		{121, []byte{8, 10, 192, 168, 0, 1, 0, 192, 168, 0, 254}},
+	}
+	if len(opts) != len(expected) {
+		t.Fatalf("Expected %d options, got %d", len(expected), len(opts))
+	}
+	for i := range expected {
+		if opts[i].Code != expected[i].Code || !bytes.Equal(opts[i].Value, expected[i].Value) {
+			t.Errorf("Expected %v, got %v", expected[i], opts[i])
+		}
+	}
+
+	large := uint32(256)
+	invalids := map[string]conf.DHCP4Option{
+		"unknown name":     {Name: "nosuch", String: "a"},
+		"no value":         {Name: "ntp-servers"},
+		"two values":       {Name: "ntp-servers", IPs: []string{"192.168.0.1"}, String: "a"},
+		"wrong type":       {Name: "ntp-servers", String: "a"},
+		"wrong code":       {Name: "ntp-servers", Code: 43, IPs: []string{"192.168.0.1"}},
+		"reserved":         {Code: 53, Hex: "01"},
+		"no name, no code": {String: "a"},
+		"invalid ip":       {Name: "ntp-servers", IPs: []string{"fd00::1"}},
+		"invalid hex":      {Name: "vendor-specific", Hex: "xx"},
+		"too large":        {Name: "default-ip-ttl", Uint: &large},
+		"too long":         {Code: 252, String: string(make([]byte, 256))},
+		"invalid route":    {Name: "classless-static-routes", Routes: []conf.DHCP4Route{{Destination: "10.0.0.0", Router: "192.168.0.1"}}},
+	}
+	for name, c := range invalids {
+		if _, err := compileDHCP4Options([]conf.DHCP4Option{c}); err == nil {
+			t.Errorf("%s must be rejected", name)
+		}
+	}
+	if _, err := compileDHCP4Options([]conf.DHCP4Option{{Code: 252, String: "a"}, {Code: 252, String: "b"}}); err == nil {
+		t.Errorf("Duplicated options must be rejected")
+	}
+}
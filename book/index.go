@@ -0,0 +1,96 @@
+package book
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// buildIndex makes hash indexes for the lookup methods.
+// Call it only once, after the book is validated.
+func (b *Book) buildIndex() {
+	b.hwaddrIndex = make(map[string]*Interface)
+	b.machineIndex = make(map[string]*Machine)
+	b.fqdnIndex = make(map[string][]*Interface)
+	b.ipv4Index = make(map[string]*Interface)
+	b.ipv6Index = make(map[string]*Interface)
+	b.duidIndex = make(map[string]*Interface)
+	b.recordIndex = make(map[string][]dns.RR)
+	b.nameIndex = make(map[string]struct{})
+
+	// Walk machines in a fixed order, so that a name shared by several
+	// interfaces always resolves the same way.
+	names := make([]string, 0, len(b.Machines))
+	for name := range b.Machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m := b.Machines[name]
+		for i := range m.Interfaces {
+			nic := &m.Interfaces[i]
+			b.hwaddrIndex[string(nic.HardwareAddr)] = nic
+			b.machineIndex[string(nic.HardwareAddr)] = m
+			b.ipv4Index[string(nic.IPv4Addr.To4())] = nic
+			if nic.IPv6Addr != nil {
+				b.ipv6Index[string(nic.IPv6Addr.To16())] = nic
+			}
+			if nic.DUID != nil {
+				b.duidIndex[string(nic.DUID)] = nic
+			}
+			for j, fqdn := range nic.Names {
+				if indexOf(nic.Names[:j], fqdn) >= 0 {
+					continue
+				}
+				b.fqdnIndex[fqdn] = append(b.fqdnIndex[fqdn], nic)
+				b.addName(fqdn)
+			}
+		}
+	}
+	for _, rr := range b.Records {
+		name := rr.Header().Name
+		b.recordIndex[name] = append(b.recordIndex[name], rr)
+		b.addName(name)
+	}
+	for _, zone := range b.DNS.Zones {
+		b.addName(zone.Name)
+	}
+}
+
+// addName adds the name and all its ancestors to nameIndex.
+func (b *Book) addName(name string) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		b.nameIndex[name[off:]] = struct{}{}
+	}
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookupName returns the interfaces which own the name, ignoring case.
+// Exact names match before wildcards. See RFC 4592.
+func (b *Book) lookupName(name string) []*Interface {
+	name = strings.ToLower(name)
+	if nics, ok := b.fqdnIndex[name]; ok {
+		return nics
+	}
+	if b.NameExists(name) {
+		// Wildcards never match existing names, even if they are empty non-terminals.
+		return nil
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if encloser := name[off:]; b.NameExists(encloser) {
+			// The closest encloser.
+			return b.fqdnIndex["*."+encloser]
+		}
+	}
+	return nil
+}
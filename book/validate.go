@@ -1,9 +1,12 @@
 package book
 
 import (
+	"encoding/hex"
 	"fmt"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
 )
 
 func (b *Book) Validate() error {
@@ -15,10 +18,30 @@ func (b *Book) Validate() error {
 		}
 	}
 
+	for i, z := range b.DNS.Zones {
+		for _, another := range b.DNS.Zones[:i] {
+			if z.Name == another.Name {
+				return fmt.Errorf("zone %s is declared twice", z.Name)
+			}
+		}
+	}
+
+	err = b.validateNames()
+	if err != nil {
+		return err
+	}
+	err = b.validateRecords()
+	if err != nil {
+		return err
+	}
 	err = b.validateV4()
 	if err != nil {
 		return err
 	}
+	err = b.validateV6()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -63,3 +86,138 @@ func (b *Book) validateV4() error {
 
 	return nil
 }
+
+func (b *Book) validateV6() error {
+	ip2hw := make(map[string]*Machine)
+	for name, m := range b.Machines {
+		for _, nic := range m.Interfaces {
+			ipv6addr := nic.IPv6Addr
+			if ipv6addr == nil {
+				continue
+			}
+			ipv6addrStr := ipv6addr.String()
+			if another, ok := ip2hw[ipv6addrStr]; ok {
+				return fmt.Errorf("IPv6Addr %s (assigned to %s) is also assigned to %s", ipv6addrStr, name, another.Name)
+			}
+			if len(b.V6Networks) > 0 && b.LookupV6NetworkForIP(ipv6addr) == nil {
+				log.Warnf("IPv6Addr %s (assigned to %s) is not in all networks managed by disq.", ipv6addrStr, name)
+			}
+			ip2hw[ipv6addrStr] = m
+		}
+	}
+	duid2hw := make(map[string]*Machine)
+	for name, m := range b.Machines {
+		for _, nic := range m.Interfaces {
+			if nic.DUID == nil {
+				continue
+			}
+			duidStr := hex.EncodeToString(nic.DUID)
+			if another, ok := duid2hw[duidStr]; ok {
+				return fmt.Errorf("DUID %s (assigned to %s) is also assigned to %s", duidStr, name, another.Name)
+			}
+			duid2hw[duidStr] = m
+		}
+	}
+	return nil
+}
+
+func (b *Book) validateNames() error {
+	shared := make(map[string]bool)
+	for _, fqdn := range b.DNS.SharedNames {
+		shared[fqdn] = true
+	}
+	name2m := make(map[string]*Machine)
+	warned := make(map[string]bool)
+	for name, m := range b.Machines {
+		for _, nic := range m.Interfaces {
+			for j, fqdn := range nic.Names {
+				if indexOf(nic.Names[:j], fqdn) >= 0 {
+					continue
+				}
+				another, ok := name2m[fqdn]
+				switch {
+				case !ok || shared[fqdn]:
+				case another == m && !strings.HasPrefix(fqdn, "*."):
+					return fmt.Errorf("name %s is assigned to several interfaces of %s, but not declared as a shared name", fqdn, name)
+				case warned[fqdn]:
+				case another != m:
+					warned[fqdn] = true
+					log.Warnf("name %s (assigned to %s) is also assigned to %s, but not declared as a shared name.", fqdn, name, another.Name)
+				default:
+					warned[fqdn] = true
+					log.Warnf("wildcard %s is assigned to several interfaces of %s, but not declared as a shared name.", fqdn, name)
+				}
+				name2m[fqdn] = m
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Book) validateRecords() error {
+	owners := make(map[string][]dns.RR)
+	for _, rr := range b.Records {
+		name := rr.Header().Name
+		owners[name] = append(owners[name], rr)
+	}
+	fqdns := make(map[string]bool)
+	for _, m := range b.Machines {
+		for _, nic := range m.Interfaces {
+			for _, fqdn := range nic.Names {
+				fqdns[fqdn] = true
+			}
+		}
+	}
+	apexes := make(map[string]bool)
+	for _, z := range b.DNS.Zones {
+		apexes[z.Name] = true
+	}
+
+	// See RFC 1034 3.6.2: If a CNAME RR is present at a node, no other data should be present.
+	for name, rrs := range owners {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeCNAME {
+				continue
+			}
+			if len(rrs) > 1 || fqdns[name] || apexes[name] {
+				return fmt.Errorf("CNAME %s can't coexist with other data", name)
+			}
+		}
+	}
+
+	for _, rr := range b.Records {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			target = rr.Target
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		if target == "." || b.LookupZone(target) == nil {
+			// "." means the service is not available, and names out of our zones can't be checked.
+			continue
+		}
+		if !fqdns[target] && len(owners[target]) == 0 {
+			return fmt.Errorf("target %s of %s is not found", target, rr.Header().Name)
+		}
+		if rr.Header().Rrtype != dns.TypeCNAME && len(owners[target]) > 0 && owners[target][0].Header().Rrtype == dns.TypeCNAME {
+			// See RFC 2181 10.3
+			log.Warnf("target %s of %s is an alias, which is not allowed for %s records.", target, rr.Header().Name, dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+
+	for name := range owners {
+		visited := make(map[string]bool)
+		for next := name; len(owners[next]) > 0 && owners[next][0].Header().Rrtype == dns.TypeCNAME; next = owners[next][0].(*dns.CNAME).Target {
+			if visited[next] {
+				return fmt.Errorf("CNAME %s makes a loop", name)
+			}
+			visited[next] = true
+		}
+	}
+	return nil
+}
@@ -14,6 +14,8 @@ import (
 
 	"fmt"
 
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/fatih/color"
 	"github.com/ledyba/disq"
@@ -27,6 +29,7 @@ import (
 var config = flag.String("config", "./config.json", "Config file path")
 var zabbixHost = flag.String("zabbix", "", "Zabbix server addr")
 var verbose = flag.Bool("v", false, "BE VERBOSE.")
+var stateDir = flag.String("state-dir", "", "Directory to keep lease history across restarts. Overrides state-dir in the config.")
 
 var hostname string
 var sender *zabbix.Sender
@@ -52,6 +55,7 @@ func reload(s *disq.Server) {
 		log.WithField("Module", "Reload").WithError(err).Error("Failed to parse config file")
 		return
 	}
+	cfg.ModTime = configModTime()
 
 	b, err := book.FromConfig(cfg)
 	if err != nil {
@@ -65,6 +69,17 @@ func reload(s *disq.Server) {
 	}
 }
 
+// configModTime returns when the config file was modified,
+// or zero time if unknown.
+func configModTime() time.Time {
+	fi, err := os.Stat(*config)
+	if err != nil {
+		log.WithError(err).Warn("Failed to stat config file")
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
 func sendZabbix(msg string) {
 	if sender == nil {
 		return
@@ -126,6 +141,7 @@ Git Revision:
 	if err != nil {
 		log.WithError(err).Fatal("Failed to parse config file")
 	}
+	cfg.ModTime = configModTime()
 
 	b, err := book.FromConfig(cfg)
 	if err != nil {
@@ -133,6 +149,20 @@ Git Revision:
 	}
 
 	s := disq.FromBook(b)
+	dir := cfg.StateDir
+	if len(*stateDir) > 0 {
+		dir = *stateDir
+	}
+	if len(dir) > 0 {
+		err = s.OpenLeaseJournal(dir)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to load lease history")
+		}
+	}
+	err = s.OpenICMPProber()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to prepare probing addresses")
+	}
 	s.Start()
 
 	sigChan := make(chan os.Signal, 1)
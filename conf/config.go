@@ -2,28 +2,138 @@ package conf
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type Config struct {
 	DNS        DNS                  `json:"dns"`
 	V4Networks map[string]V4Network `json:"v4networks"`
+	V6Networks map[string]V6Network `json:"v6networks,omitempty"`
 	Machines   map[string]Machine   `json:"machines"`
+	Records    []Record             `json:"records,omitempty"`
+	// Directory to keep lease history across restarts. Empty disables it.
+	StateDir string `json:"state-dir,omitempty"` /* (ex) /var/lib/disq */
+	// When the config file was modified. Default serials of zones are made from it.
+	ModTime time.Time `json:"-"`
 }
 
 type DNS struct {
-	Listen    string   `json:"listen"`
-	Networks  []string `json:"networks"`
-	LocalTTL  int      `json:"local-ttl"`
-	GlobalTTL int      `json:"global-ttl"`
+	Listen   string   `json:"listen"`
+	Networks []string `json:"networks"`
+	LocalTTL int      `json:"local-ttl"`
+	// Deprecated: TTLs of upstream answers are relayed as they are.
+	GlobalTTL              int      `json:"global-ttl"`
+	Upstreams              []string `json:"upstreams,omitempty"` /* (ex) 8.8.8.8, 8.8.4.4:53 */
+	UpstreamTimeoutSeconds float64  `json:"upstream-timeout-seconds,omitempty"`
+	Cache                  DNSCache `json:"cache"`
+	Zones                  []Zone   `json:"zones,omitempty"`
+	// Requests from these networks are authorized by EDNS Client Subnet option
+	// instead of their source address. (ex) DNS proxies, load balancers.
+	ClientSubnetProxies []string `json:"client-subnet-proxies,omitempty"` /* (ex) 10.0.0.0/24 */
+	// Names assigned to several interfaces on purpose. All the addresses are
+	// answered in rotated order.
+	SharedNames []string `json:"shared-names,omitempty"` /* (ex) api.eagle-jump. */
+}
+
+// Zone which disq is authoritative for.
+// Names in it are never forwarded to upstreams.
+type Zone struct {
+	Name        string   `json:"name"`        /* (ex) eagle-jump. */
+	NameServers []string `json:"nameservers"` /* (ex) ns1.eagle-jump. */
+	Hostmaster  string   `json:"hostmaster,omitempty"`
+	Serial      uint32   `json:"serial,omitempty"` /* 0 means the time when the config file is modified */
+	Refresh     uint32   `json:"refresh,omitempty"`
+	Retry       uint32   `json:"retry,omitempty"`
+	Expire      uint32   `json:"expire,omitempty"`
+	NegativeTTL uint32   `json:"negative-ttl,omitempty"`
+}
+
+// Record served in addition to the fqdns of machines.
+type Record struct {
+	Name       string   `json:"name"`                 /* (ex) db.eagle-jump. */
+	Type       string   `json:"type"`                 /* CNAME, MX, TXT or SRV */
+	TTL        int      `json:"ttl,omitempty"`        /* 0 means local-ttl */
+	Target     string   `json:"target,omitempty"`     /* CNAME, MX, SRV (ex) aoba.eagle-jump. */
+	Preference uint16   `json:"preference,omitempty"` /* MX */
+	Priority   uint16   `json:"priority,omitempty"`   /* SRV */
+	Weight     uint16   `json:"weight,omitempty"`     /* SRV */
+	Port       uint16   `json:"port,omitempty"`       /* SRV */
+	Text       []string `json:"text,omitempty"`       /* TXT */
+}
+
+// Cache for answers from upstreams.
+type DNSCache struct {
+	MaxEntries int `json:"max-entries"`       /* 0 disables the cache */
+	MinTTL     int `json:"min-ttl,omitempty"` /* in seconds */
+	MaxTTL     int `json:"max-ttl,omitempty"` /* in seconds. 0 means no limit. */
 }
 
 type V4Network struct {
+	InterfaceName     string        `json:"interface"`
+	Network           string        `json:"network"`
+	DHCP4Listen       string        `json:"dhcp4-listen"`
+	LeaseDurationDays float64       `json:"lease-duration-days"`
+	NameServerAddrs   []string      `json:"nameserver-address,omitempty"`
+	GatewayAddr       string        `json:"gateway-address,omitempty"`
+	HostName          string        `json:"host-name,omitempty"`     /* "fqdn" (default), "machine" or "none" */
+	DomainName        string        `json:"domain-name,omitempty"`   /* (ex) eagle-jump. */
+	DomainSearch      []string      `json:"domain-search,omitempty"` /* (ex) eagle-jump., k8s.eagle-jump. */
+	DHCP4Options      []DHCP4Option `json:"dhcp4-options,omitempty"`
+	Boot              *Boot         `json:"boot,omitempty"`
+	TFTPListen        string        `json:"tftp-listen,omitempty"` /* (ex) 192.168.0.1:69 */
+	TFTPRoot          string        `json:"tftp-root,omitempty"`   /* (ex) /srv/tftp */
+	DynamicRange      *AddressRange `json:"dynamic-range,omitempty"`
+	// Ping addresses before offering them for the first time. It needs a raw socket,
+	// and the other clients of the interface wait while probing.
+	Probe bool `json:"probe,omitempty"`
+	// Addresses declined by clients or answering to probes are not offered for a while.
+	ConflictCooldownMinutes float64 `json:"conflict-cooldown-minutes,omitempty"` /* 10 minutes by default */
+	// Answer DHCPINFORM from machines not in the config, too.
+	InformUnknownClients bool `json:"inform-unknown-clients,omitempty"`
+	// The network is behind DHCP relay agents, and its packets arrive at the interface.
+	// Relayed networks don't have dhcp4-listen, since they are served by the network of the interface.
+	Relayed bool `json:"relayed,omitempty"`
+}
+
+// AddressRange is inclusive.
+type AddressRange struct {
+	Start string `json:"start"` /* (ex) 192.168.0.100 */
+	End   string `json:"end"`   /* (ex) 192.168.0.199 */
+}
+
+// Boot is for network boot (PXE).
+type Boot struct {
+	NextServer string `json:"next-server,omitempty"` /* (ex) 192.168.0.1 */
+	ServerName string `json:"server-name,omitempty"` /* (ex) tftp.eagle-jump */
+	File       string `json:"file,omitempty"`        /* (ex) pxelinux.0 */
+	// By client architecture: bios, efi-ia32, efi-bc, efi-x86-64, efi-arm32, efi-arm64 or the number.
+	Files map[string]string `json:"files,omitempty"` /* (ex) {"efi-x86-64": "grubx64.efi"} */
+}
+
+// DHCP4Option is sent in addition to the options disq knows.
+// Exactly one of the values must be set.
+type DHCP4Option struct {
+	Name   string       `json:"name,omitempty"` /* (ex) ntp-servers */
+	Code   int          `json:"code,omitempty"` /* for options without names */
+	IPs    []string     `json:"ips,omitempty"`  /* (ex) 192.168.0.1 */
+	String string       `json:"string,omitempty"`
+	Uint   *uint32      `json:"uint,omitempty"`   /* sized as the option needs, or 4 bytes for options without names */
+	Hex    string       `json:"hex,omitempty"`    /* (ex) 01:02:03 */
+	Routes []DHCP4Route `json:"routes,omitempty"` /* for classless-static-routes */
+}
+
+type DHCP4Route struct {
+	Destination string `json:"destination"` /* (ex) 10.0.0.0/8 */
+	Router      string `json:"router"`      /* (ex) 192.168.0.1 */
+}
+
+type V6Network struct {
 	InterfaceName     string   `json:"interface"`
-	Network           string   `json:"network"`
-	DHCP4Listen       string   `json:"dhcp4-listen"`
+	Network           string   `json:"network"`      /* (ex) fd00::/64 */
+	DHCP6Listen       string   `json:"dhcp6-listen"` /* (ex) [::]:547 */
 	LeaseDurationDays float64  `json:"lease-duration-days"`
 	NameServerAddrs   []string `json:"nameserver-address,omitempty"`
-	GatewayAddr       string   `json:"gateway-address,omitempty"`
+	DomainSearch      []string `json:"domain-search,omitempty"`
 }
 
 type Machine []Interface
@@ -31,7 +141,17 @@ type Machine []Interface
 type Interface struct {
 	HardwareAddr string `json:"hardware-address"`
 	IPv4Addr     string `json:"ipv4-address"`
+	IPv6Addr     string `json:"ipv6-address,omitempty"`
+	DUID         string `json:"duid,omitempty"` /* (ex) 00:03:00:01:72:00:07:ef:42:80 */
 	Fqdn         string `json:"fqdn,omitempty"` /* (ex) zoi.eaglejump.jp. */
+	// Other names of the interface. Wildcards are also allowed.
+	Fqdns []string `json:"fqdns,omitempty"` /* (ex) www.eaglejump.jp., *.k8s.eaglejump.jp. */
+	// Overrides the options of the network.
+	DHCP4Options []DHCP4Option `json:"dhcp4-options,omitempty"`
+	Boot         *Boot         `json:"boot,omitempty"`
+	// If set, requests for the interface are accepted only via the relay agent port.
+	RelayCircuitID string `json:"relay-circuit-id,omitempty"` /* (ex) Gi1/0/1 */
+	RelayRemoteID  string `json:"relay-remote-id,omitempty"`  /* (ex) tor-1 */
 }
 
 func Load(data []byte) (*Config, error) {
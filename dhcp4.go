@@ -10,9 +10,12 @@ import (
 
 	"math/rand"
 
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 	dhcp "github.com/krolaw/dhcp4"
 	"github.com/krolaw/dhcp4/conn"
+	"github.com/ledyba/disq/book"
 )
 
 type dhcp4Server struct {
@@ -55,7 +58,7 @@ func (s *dhcp4Server) Serve() error {
 		}
 	}()
 	s.log().Infof("Serving @ %s", network.DHCP4Listen)
-	return dhcp.Serve(c, s)
+	return dhcp.Serve(&relayConn{c}, s)
 }
 
 func (s *dhcp4Server) Shutdown() error {
@@ -103,7 +106,128 @@ func mask2bits(mask net.IPMask) int {
 	return ones
 }
 
+// hostName returns the value of Host Name option for the client,
+// or empty string if it should not be sent.
+func hostName(b *book.Book, network *book.V4Network, hwaddr net.HardwareAddr) string {
+	switch network.HostName {
+	case book.HostNameFromFQDN:
+		if nic := b.LookupInterfaceForHardwareAddr(hwaddr); nic != nil && len(nic.Fqdn) > 0 {
+			return strings.SplitN(nic.Fqdn, ".", 2)[0]
+		}
+		fallthrough
+	case book.HostNameFromMachine:
+		if m := b.LookupMachineForHardwareAddr(hwaddr); m != nil {
+			return m.Name
+		}
+	}
+	return ""
+}
+
+// bootParams returns the settings for network boot. Those of the machine
+// override those of the network.
+func bootParams(network *book.V4Network, nic *book.Interface, arch []byte) (nextServer net.IP, serverName, file string) {
+	boots := []*book.Boot{network.Boot}
+	if nic != nil {
+		boots = append(boots, nic.Boot)
+	}
+	for _, boot := range boots {
+		if boot == nil {
+			continue
+		}
+		if boot.NextServer != nil {
+			nextServer = boot.NextServer
+		}
+		if len(boot.ServerName) > 0 {
+			serverName = boot.ServerName
+		}
+		if f := boot.BootFile(arch); len(f) > 0 {
+			file = f
+		}
+	}
+	// Boot files are served by ourselves.
+	if nextServer == nil && len(file) > 0 && len(network.TFTPListen) > 0 {
+		nextServer = network.MyAddress
+	}
+	return
+}
+
+// withIdentity wraps f to record the identity the client sent, too.
+func withIdentity(options dhcp.Options, f func(l *Lease, now time.Time)) func(l *Lease, now time.Time) {
+	return func(l *Lease, now time.Time) {
+		if id, ok := options[dhcp.OptionClientIdentifier]; ok {
+			l.ClientID = append([]byte(nil), id...)
+		}
+		if name, ok := options[dhcp.OptionHostName]; ok {
+			l.HostName = string(name)
+		}
+		f(l, now)
+	}
+}
+
+// recordLease updates the lease of the client, with the identity it sent.
+func (s *dhcp4Server) recordLease(hwaddr net.HardwareAddr, options dhcp.Options, f func(l *Lease, now time.Time)) {
+	_, err := s.parent.leases.update(s.network, hwaddr, withIdentity(options, f))
+	if err != nil {
+		s.reportJournalError(err)
+	}
+}
+
+func (s *dhcp4Server) reportJournalError(err error) {
+	s.log().WithError(err).Error("Failed to record the lease")
+	s.parent.ErrorStream <- &LeaseJournalError{
+		Err: err,
+	}
+}
+
+// conflicts probes the address, and reports true if it is used by someone.
+// Errors on probing are only logged, not to stop the service.
+func (s *dhcp4Server) conflicts(network *book.V4Network, hwaddr net.HardwareAddr, ip net.IP) bool {
+	prober := s.parent.Prober
+	if prober == nil || !network.Probe {
+		return false
+	}
+	used, err := prober.Probe(network, ip, probeTimeout)
+	if err != nil {
+		s.log().WithError(err).Warnf("Failed to probe %v", ip)
+		return false
+	}
+	if !used {
+		return false
+	}
+	err = &DHCP4AddressConflictError{
+		Network:      s.network,
+		HardwareAddr: hwaddr,
+		Addr:         ip,
+	}
+	s.log().WithError(err).Errorf("Offer withheld. %v is not offered for %v.", ip, network.ConflictCooldown)
+	s.parent.ErrorStream <- err
+	s.parent.quarantine.add(s.network, ip, network.ConflictCooldown)
+	return true
+}
+
 func (s *dhcp4Server) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
+	giaddr := p.GIAddr()
+	if giaddr.Equal(net.IPv4zero) {
+		return s.serveDHCP(p, msgType, options)
+	}
+	// Relayed requests are for the network of the relay agent.
+	b := s.parent.book()
+	name, ok := relayedNetwork(b, b.V4Networks[s.network], giaddr)
+	if !ok {
+		s.log().Warnf("Request from %s relayed by %v ignored: no network for the relay agent", p.CHAddr().String(), giaddr)
+		return nil
+	}
+	if name == s.network {
+		return s.serveDHCP(p, msgType, options)
+	}
+	relayed := &dhcp4Server{
+		parent:  s.parent,
+		network: name,
+	}
+	return relayed.serveDHCP(p, msgType, options)
+}
+
+func (s *dhcp4Server) serveDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
 	errorStream := s.parent.ErrorStream
 	book := s.parent.book()
 	network := book.V4Networks[s.network]
@@ -127,18 +251,92 @@ func (s *dhcp4Server) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 	if len(network.GatewayAddr) > 0 {
 		servOptions[dhcp.OptionRouter] = []byte(network.GatewayAddr)
 	}
+	if len(network.DomainName) > 0 {
+		servOptions[dhcp.OptionDomainName] = []byte(strings.TrimSuffix(network.DomainName, "."))
+	}
+	if len(network.DomainSearch) > 0 {
+		// See RFC 3397.
+		servOptions[dhcp.OptionDomainSearch] = encodeDomainList(network.DomainSearch)
+	}
 
 	var err error
 	sname := string(p.SName())
 	hwaddr := p.CHAddr()
 	ipaddr := book.LookupIPForHardwareAddr(hwaddr)
+	// Machines not in the book get addresses from the dynamic range, if configured.
+	dynamic := ipaddr == nil && network.DynamicRange != nil
 	leaseDuration := time.Duration(float64(time.Hour) * 24 * network.LeaseDurationDays)
+	host := hostName(book, network, hwaddr)
+	if len(host) > 0 {
+		servOptions[dhcp.OptionHostName] = []byte(host)
+	}
+	nic := book.LookupInterfaceForHardwareAddr(hwaddr)
+	// Relay agents expect Relay Agent Information option back. See RFC 3046.
+	relayInfo := options[dhcp.OptionRelayAgentInformation]
+	withRelayInfo := func(opts []dhcp.Option) []dhcp.Option {
+		if relayInfo != nil {
+			opts = append(opts, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: relayInfo})
+		}
+		return opts
+	}
+	if giaddr := net.IP(p.GIAddr()); !giaddr.Equal(net.IPv4zero) {
+		circuitID, remoteID := parseRelayAgentInfo(relayInfo)
+		s.log().Infof("%s from %s relayed by %v (circuit-id=%q, remote-id=%q)", msgType, hwaddr.String(), giaddr, circuitID, remoteID)
+		if nic != nil && !matchesRelayAgent(nic, circuitID, remoteID) {
+			s.log().Warnf("%s from %s ignored: expected circuit-id=%q, remote-id=%q", msgType, hwaddr.String(), nic.RelayCircuitID, nic.RelayRemoteID)
+			return nil
+		}
+	}
+	nextServer, bootServerName, bootFile := bootParams(network, nic, options[dhcp.OptionClientArchitecture])
+	if len(bootServerName) > 0 {
+		servOptions[dhcp.OptionTFTPServerName] = []byte(bootServerName)
+	}
+	if len(bootFile) > 0 {
+		servOptions[dhcp.OptionBootFileName] = []byte(bootFile)
+	}
+	// Options in the tables are the most specific.
+	for _, opt := range network.DHCP4Options {
+		servOptions[dhcp.OptionCode(opt.Code)] = opt.Value
+	}
+	if nic != nil {
+		for _, opt := range nic.DHCP4Options {
+			servOptions[dhcp.OptionCode(opt.Code)] = opt.Value
+		}
+	}
+	reply := func(mt dhcp.MessageType, yIAddr net.IP) dhcp.Packet {
+		res := dhcp.ReplyPacket(p, mt,
+			network.MyAddress, yIAddr,
+			leaseDuration,
+			withRelayInfo(servOptions.SelectOrderOrAll(options[dhcp.OptionParameterRequestList])))
+		// Some PXE clients only see the fixed fields of BOOTP.
+		if nextServer != nil {
+			res.SetSIAddr(nextServer)
+		}
+		if len(bootServerName) > 0 {
+			res.SetSName([]byte(bootServerName))
+		}
+		if len(bootFile) > 0 {
+			res.SetFile([]byte(bootFile))
+		}
+		return res
+	}
 	switch msgType {
 	case dhcp.Discover:
+		prev, known := s.parent.leases.get(s.network, hwaddr)
+		if dynamic {
+			ipaddr = s.leaseDynamic(network, hwaddr, nil, options, func(l *Lease, now time.Time) {
+				l.Offered = now
+			})
+		}
 		if ipaddr == nil {
 			s.log().WithError(err).Errorf("Could not find address for %s", hwaddr.String())
 			return nil
 		}
+		if s.parent.quarantine.contains(s.network, ipaddr) {
+			// Fix the host using the address, or wait for the cool-down.
+			s.log().Warnf("Offer to %s withheld: %v is in quarantine", hwaddr.String(), ipaddr)
+			return nil
+		}
 		s.log().Infof(`Discover from "%s" (%s)
 Replying Offer:
   ServerIP: %v
@@ -147,20 +345,47 @@ Replying Offer:
   Options:
     Netmask: /%d
     Nameservers: %v
-    Router: %v`,
+    Router: %v
+    HostName: %s
+    DomainName: %s
+    DomainSearch: %v
+  Boot:
+    NextServer: %v
+    File: %s`,
 			sname, hwaddr.String(),
 			network.MyAddress,
 			ipaddr, leaseDuration,
 			mask2bits(network.Network.Mask),
 			nsList,
-			network.GatewayAddr)
-		//TODO: wait
-		return dhcp.ReplyPacket(
-			p, dhcp.Offer,
-			network.MyAddress,
-			ipaddr,
-			leaseDuration,
-			servOptions.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+			network.GatewayAddr,
+			host,
+			network.DomainName,
+			network.DomainSearch,
+			nextServer,
+			bootFile)
+		if !known || prev.Offered.IsZero() || !prev.IP.Equal(ipaddr) {
+			// First offer of the address to the client.
+			if s.conflicts(network, hwaddr, ipaddr) {
+				if dynamic {
+					// Withdraw the offer.
+					_, err = s.parent.leases.update(s.network, hwaddr, func(l *Lease, now time.Time) {
+						l.IP = prev.IP
+						l.Offered = prev.Offered
+					})
+					if err != nil {
+						s.reportJournalError(err)
+					}
+				}
+				return nil
+			}
+		}
+		if !dynamic {
+			s.recordLease(hwaddr, options, func(l *Lease, now time.Time) {
+				l.IP = ipaddr
+				l.Offered = now
+			})
+		}
+		return reply(dhcp.Offer, ipaddr)
 
 	case dhcp.Request:
 		if server, ok := options[dhcp.OptionServerIdentifier]; ok && !net.IP(server).Equal(network.MyAddress) {
@@ -170,6 +395,18 @@ Replying Offer:
 		if reqIP == nil {
 			reqIP = net.IP(p.CIAddr())
 		}
+		if dynamic {
+			// The client may have got the address before we restarted.
+			ipaddr = s.leaseDynamic(network, hwaddr, reqIP, options, func(l *Lease, now time.Time) {
+				l.Acked = now
+				l.Expires = now.Add(leaseDuration)
+			})
+			if ipaddr == nil {
+				s.log().Infof("%v is not available for %s. We sent NAK back.", reqIP, hwaddr.String())
+				return dhcp.ReplyPacket(p, dhcp.NAK,
+					network.MyAddress, nil, 0, withRelayInfo(nil))
+			}
+		}
 		if !reqIP.Equal(ipaddr) {
 			// Whats wrong?
 			err = &DHCP4WrongAddressRequestedError{
@@ -181,7 +418,7 @@ Replying Offer:
 			errorStream <- err
 			s.log().WithError(err).Error("Invalid request received. We sent NAK back.")
 			return dhcp.ReplyPacket(p, dhcp.NAK,
-				network.MyAddress, nil, 0, nil)
+				network.MyAddress, nil, 0, withRelayInfo(nil))
 		}
 		s.log().Infof(`Request from "%s" (%s)
 Replying ACK:
@@ -191,32 +428,107 @@ Replying ACK:
   Options:
     Netmask: /%d
     Nameservers: %v
-    Router: %v`,
+    Router: %v
+    HostName: %s
+    DomainName: %s
+    DomainSearch: %v
+  Boot:
+    NextServer: %v
+    File: %s`,
 			sname, hwaddr.String(),
 			network.MyAddress,
 			ipaddr, leaseDuration,
 			mask2bits(network.Network.Mask),
 			nsList,
-			network.GatewayAddr)
-		return dhcp.ReplyPacket(p, dhcp.ACK,
-			network.MyAddress, reqIP,
-			leaseDuration,
-			servOptions.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+			network.GatewayAddr,
+			host,
+			network.DomainName,
+			network.DomainSearch,
+			nextServer,
+			bootFile)
+		if !dynamic {
+			s.recordLease(hwaddr, options, func(l *Lease, now time.Time) {
+				l.IP = append(net.IP(nil), reqIP...) // reqIP points into the packet.
+				l.Acked = now
+				l.Expires = now.Add(leaseDuration)
+			})
+		}
+		return reply(dhcp.ACK, reqIP)
 
 	case dhcp.Release:
-		// Nothing to do, but log.
 		s.log().Infof("Release from %s (assigned to %v)", hwaddr.String(), ipaddr)
+		s.recordLease(hwaddr, options, func(l *Lease, now time.Time) {
+			l.IP = append(net.IP(nil), p.CIAddr()...)
+			l.Released = now
+			l.Expires = now
+		})
 		return nil
 	case dhcp.Decline:
-		// Nothing to do, but log.
-		s.log().Infof("Decline from %s (assigned to %v)", hwaddr.String(), ipaddr)
+		if server, ok := options[dhcp.OptionServerIdentifier]; ok && !net.IP(server).Equal(network.MyAddress) {
+			return nil // Message not for this dhcp server
+		}
+		// Only the address we gave the client can be declined.
+		// Otherwise anyone could withhold the addresses of the others.
+		given := ipaddr
+		if dynamic {
+			if l, ok := s.parent.leases.get(s.network, hwaddr); ok && network.DynamicRange.Contains(l.IP) && book.LookupInterfaceForIP(l.IP) == nil {
+				given = l.IP
+			}
+		}
+		declined := given
+		if ip := options[dhcp.OptionRequestedIPAddress]; len(ip) == net.IPv4len {
+			declined = append(net.IP(nil), ip...)
+		}
+		if given == nil || !declined.Equal(given) {
+			s.log().Warnf("Decline from %s for %v ignored: the address is not given to the client (%v)", hwaddr.String(), declined, given)
+			return nil
+		}
+		s.recordLease(hwaddr, options, func(l *Lease, now time.Time) {
+			l.IP = declined
+			l.Declined = now
+			l.Expires = now
+		})
+		// Two hosts are fighting over the address.
+		err = &DHCP4DeclineError{
+			Network:      s.network,
+			HardwareAddr: hwaddr,
+			Addr:         declined,
+			Message:      string(options[dhcp.OptionMessage]),
+		}
+		errorStream <- err
+		s.log().WithError(err).Errorf("Decline received. %v is not offered for %v.", declined, network.ConflictCooldown)
+		s.parent.quarantine.add(s.network, declined, network.ConflictCooldown)
 		return nil
 	case dhcp.Inform:
-		// Nothing to do, but log.
-		s.log().Infof("Inform from %s (assigned to %v)", hwaddr.String(), ipaddr)
-		return nil
+		if ipaddr == nil && !network.InformUnknownClients {
+			s.log().Infof("Inform from unknown client %s (%v) ignored", hwaddr.String(), net.IP(p.CIAddr()))
+			return nil
+		}
+		s.log().Infof(`Inform from "%s" (%s, %v)
+Replying ACK:
+  ServerIP: %v
+  Options:
+    Netmask: /%d
+    Nameservers: %v
+    Router: %v
+    HostName: %s
+    DomainName: %s
+    DomainSearch: %v`,
+			sname, hwaddr.String(), net.IP(p.CIAddr()),
+			network.MyAddress,
+			mask2bits(network.Network.Mask),
+			nsList,
+			network.GatewayAddr,
+			host,
+			network.DomainName,
+			network.DomainSearch)
+		// The client has configured its address by itself,
+		// so neither yiaddr nor lease time is sent. See RFC 2131, 3.4.
+		return dhcp.ReplyPacket(p, dhcp.ACK,
+			network.MyAddress, nil, 0,
+			withRelayInfo(servOptions.SelectOrderOrAll(options[dhcp.OptionParameterRequestList])))
 	default:
-		s.log().Error("Unknown Message: %d", msgType)
+		s.log().Errorf("Unknown Message: %d", msgType)
 	}
 	return nil
 }
@@ -1,10 +1,12 @@
 package disq
 
 import (
+	"bytes"
 	"net"
 	"testing"
 
-	"bytes"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/ledyba/disq/book"
 )
 
 func TestJoinIP(t *testing.T) {
@@ -29,3 +31,188 @@ func TestShuffleIP(t *testing.T) {
 		t.Errorf("Failed to shuffle ip. Got: %v", shuffled)
 	}
 }
+
+func newTestDHCP4Server(t *testing.T) *dhcp4Server {
+	s := newTestServer(t)
+	network := s.book().V4Networks["loopback"]
+	network.MyAddress = net.IPv4(127, 0, 0, 1).To4()
+	network.LeaseDurationDays = 1.0
+	// Loopback addresses always answer.
+	s.Prober = nil
+	return newDHCP4Server(s, "loopback")
+}
+
+func discover(ds *dhcp4Server, hwaddr string, options ...dhcp.Option) dhcp.Packet {
+	mac, _ := net.ParseMAC(hwaddr)
+	p := dhcp.RequestPacket(dhcp.Discover, mac, nil, []byte{1, 2, 3, 4}, false, options)
+	return ds.ServeDHCP(p, dhcp.Discover, p.ParseOptions())
+}
+
+// optionCodes returns option codes in the order of the packet.
+func optionCodes(p dhcp.Packet) []dhcp.OptionCode {
+	var codes []dhcp.OptionCode
+	opts := p.Options()
+	for i := 0; i < len(opts) && dhcp.OptionCode(opts[i]) != dhcp.End; {
+		if dhcp.OptionCode(opts[i]) == dhcp.Pad {
+			i++
+			continue
+		}
+		codes = append(codes, dhcp.OptionCode(opts[i]))
+		i += 2 + int(opts[i+1])
+	}
+	return codes
+}
+
+func TestDHCP4HostNameAndDomain(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	network := ds.parent.book().V4Networks["loopback"]
+	network.DomainName = "eagle-jump."
+	network.DomainSearch = []string{"eagle-jump.", "k8s.eagle-jump."}
+
+	prl := []byte{byte(dhcp.OptionDomainSearch), byte(dhcp.OptionHostName), byte(dhcp.OptionSubnetMask), byte(dhcp.OptionDomainName)}
+	res := discover(ds, "72:00:07:ef:42:80", dhcp.Option{Code: dhcp.OptionParameterRequestList, Value: prl})
+	if res == nil {
+		t.Fatal("No offer")
+	}
+	opts := res.ParseOptions()
+	if host := string(opts[dhcp.OptionHostName]); host != "aoba" {
+		t.Errorf("Expected host name aoba, got %q", host)
+	}
+	if domain := string(opts[dhcp.OptionDomainName]); domain != "eagle-jump" {
+		t.Errorf("Expected domain name eagle-jump, got %q", domain)
+	}
+	expected := []byte("\x0aeagle-jump\x00\x03k8s\x0aeagle-jump\x00")
+	if search := opts[dhcp.OptionDomainSearch]; !bytes.Equal(search, expected) {
+		t.Errorf("Unexpected domain search: %q", search)
+	}
+	codes := optionCodes(res)
+	// Message type, server identifier and lease time come first, then the requested options.
+	if len(codes) != 7 || codes[3] != dhcp.OptionDomainSearch || codes[4] != dhcp.OptionHostName || codes[5] != dhcp.OptionSubnetMask || codes[6] != dhcp.OptionDomainName {
+		t.Errorf("Options must be in the order of the parameter request list, got %v", codes)
+	}
+
+	network.HostName = book.HostNameFromMachine
+	ds.parent.book().Machines["aoba"].Name = "aoba-machine"
+	opts = discover(ds, "72:00:07:ef:42:80").ParseOptions()
+	if host := string(opts[dhcp.OptionHostName]); host != "aoba-machine" {
+		t.Errorf("Expected the machine name, got %q", host)
+	}
+
+	network.HostName = book.HostNameNone
+	opts = discover(ds, "72:00:07:ef:42:80").ParseOptions()
+	if _, ok := opts[dhcp.OptionHostName]; ok {
+		t.Errorf("Host name must not be sent")
+	}
+}
+
+func TestDHCP4Options(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	b := ds.parent.book()
+	b.V4Networks["loopback"].DHCP4Options = []book.DHCP4Option{
+		{Code: byte(dhcp.OptionNetworkTimeProtocolServers), Value: []byte{127, 0, 0, 1}},
+		{Code: byte(dhcp.OptionInterfaceMTU), Value: []byte{0x05, 0xdc}},
+	}
+	hwaddr, _ := net.ParseMAC("72:00:07:ef:42:80")
+	b.LookupInterfaceForHardwareAddr(hwaddr).DHCP4Options = []book.DHCP4Option{
+		{Code: byte(dhcp.OptionInterfaceMTU), Value: []byte{0x23, 0x28}},
+	}
+
+	opts := discover(ds, "72:00:07:ef:42:80").ParseOptions()
+	if ntp := opts[dhcp.OptionNetworkTimeProtocolServers]; !bytes.Equal(ntp, []byte{127, 0, 0, 1}) {
+		t.Errorf("Expected options of the network, got %v", ntp)
+	}
+	if mtu := opts[dhcp.OptionInterfaceMTU]; !bytes.Equal(mtu, []byte{0x23, 0x28}) {
+		t.Errorf("Expected options of the machine to override, got %v", mtu)
+	}
+
+	opts = discover(ds, "72:00:07:ef:42:81").ParseOptions()
+	if mtu := opts[dhcp.OptionInterfaceMTU]; !bytes.Equal(mtu, []byte{0x05, 0xdc}) {
+		t.Errorf("Expected options of the network, got %v", mtu)
+	}
+}
+
+func TestDHCP4Boot(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	b := ds.parent.book()
+	b.V4Networks["loopback"].Boot = &book.Boot{
+		NextServer: net.IPv4(127, 0, 0, 1).To4(),
+		File:       "pxelinux.0",
+		Files:      map[uint16]string{9: "grubx64.efi"},
+	}
+	hwaddr, _ := net.ParseMAC("72:00:07:ef:42:80")
+	b.LookupInterfaceForHardwareAddr(hwaddr).Boot = &book.Boot{
+		File: "aoba.efi",
+	}
+	uefi := dhcp.Option{Code: dhcp.OptionClientArchitecture, Value: []byte{0, 9}}
+
+	res := discover(ds, "72:00:07:ef:42:81")
+	if !res.SIAddr().Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected next server in siaddr, got %v", res.SIAddr())
+	}
+	if file := res.ParseOptions()[dhcp.OptionBootFileName]; string(file) != "pxelinux.0" {
+		t.Errorf("Expected the default boot file, got %q", file)
+	}
+	if file := string(res.File()); file != "pxelinux.0" {
+		t.Errorf("Expected the default boot file in the file field, got %q", file)
+	}
+
+	res = discover(ds, "72:00:07:ef:42:81", uefi)
+	if file := res.ParseOptions()[dhcp.OptionBootFileName]; string(file) != "grubx64.efi" {
+		t.Errorf("Expected the boot file for the architecture, got %q", file)
+	}
+
+	res = discover(ds, "72:00:07:ef:42:80", uefi)
+	if file := res.ParseOptions()[dhcp.OptionBootFileName]; string(file) != "aoba.efi" {
+		t.Errorf("Expected the boot file of the machine, got %q", file)
+	}
+	if !res.SIAddr().Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected next server of the network, got %v", res.SIAddr())
+	}
+
+	// Without next-server, boot files are served by our TFTP server.
+	b.V4Networks["loopback"].Boot.NextServer = nil
+	b.V4Networks["loopback"].TFTPListen = "127.0.0.1:69"
+	res = discover(ds, "72:00:07:ef:42:81")
+	if !res.SIAddr().Equal(b.V4Networks["loopback"].MyAddress) {
+		t.Errorf("Expected our address as next server, got %v", res.SIAddr())
+	}
+}
+
+func TestDHCP4Inform(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	network := ds.parent.book().V4Networks["loopback"]
+	network.GatewayAddr = net.IPv4(127, 0, 0, 1).To4()
+	prl := dhcp.Option{Code: dhcp.OptionParameterRequestList, Value: []byte{byte(dhcp.OptionRouter), byte(dhcp.OptionSubnetMask)}}
+
+	res := request(ds, dhcp.Inform, "72:00:07:ef:42:80", net.IPv4(127, 0, 0, 2).To4(), prl)
+	if res == nil {
+		t.Fatal("Expected ACK")
+	}
+	opts := res.ParseOptions()
+	if mt := opts[dhcp.OptionDHCPMessageType]; len(mt) != 1 || dhcp.MessageType(mt[0]) != dhcp.ACK {
+		t.Errorf("Expected ACK, got %v", mt)
+	}
+	if !res.YIAddr().Equal(net.IPv4zero) {
+		t.Errorf("yiaddr must be zero, got %v", res.YIAddr())
+	}
+	if _, ok := opts[dhcp.OptionIPAddressLeaseTime]; ok {
+		t.Error("Lease time must not be sent")
+	}
+	if router := net.IP(opts[dhcp.OptionRouter]); !router.Equal(network.GatewayAddr) {
+		t.Errorf("Expected router %v, got %v", network.GatewayAddr, router)
+	}
+	mac, _ := net.ParseMAC("72:00:07:ef:42:80")
+	if _, ok := ds.parent.Lease("loopback", mac); ok {
+		t.Error("Inform must not make leases")
+	}
+
+	// Unknown clients are ignored by default.
+	if res := request(ds, dhcp.Inform, "02:00:00:00:00:01", net.IPv4(127, 0, 0, 50).To4(), prl); res != nil {
+		t.Error("Inform from unknown client must be ignored")
+	}
+	network.InformUnknownClients = true
+	res = request(ds, dhcp.Inform, "02:00:00:00:00:01", net.IPv4(127, 0, 0, 50).To4(), prl)
+	if res == nil || !net.IP(res.ParseOptions()[dhcp.OptionRouter]).Equal(network.GatewayAddr) {
+		t.Errorf("Expected ACK with options, got %v", res)
+	}
+}
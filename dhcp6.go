@@ -0,0 +1,223 @@
+package disq
+
+import (
+	"net"
+	"time"
+
+	"fmt"
+
+	"io"
+
+	"bytes"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ledyba/disq/book"
+	"github.com/ledyba/disq/dhcp6"
+)
+
+type dhcp6Server struct {
+	parent  *Server
+	network string
+	conn    dhcp6conn
+}
+
+type dhcp6conn interface {
+	dhcp6.ServeConn
+	io.Closer
+}
+
+func newDHCP6Server(parent *Server, network string) *dhcp6Server {
+	s := &dhcp6Server{
+		parent:  parent,
+		network: network,
+		conn:    nil,
+	}
+	return s
+}
+
+// Network for the clients
+func (s *dhcp6Server) Serve() error {
+	book := s.parent.book()
+	network, ok := book.V6Networks[s.network]
+
+	if !ok {
+		return fmt.Errorf("[DHCP6][BUG] network not found: %s", s.network)
+	}
+	c, err := dhcp6.NewUDP6FilterListener(network.Interface.Name, network.DHCP6Listen)
+	if err != nil {
+		return err
+	}
+	s.conn = c
+	defer func() {
+		if s.conn != nil {
+			s.Shutdown()
+		}
+	}()
+	s.log().Infof("Serving @ %s", network.DHCP6Listen)
+	return dhcp6.Serve(c, s)
+}
+
+func (s *dhcp6Server) Shutdown() error {
+	var err error
+	if s.conn == nil {
+		return nil
+	}
+	err = s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *dhcp6Server) log() *log.Entry {
+	return log.
+		WithField("Module", "DHCP6").
+		WithField("Network", s.network)
+}
+
+func serverDUID(network *book.V6Network) dhcp6.DUID {
+	return dhcp6.NewDUIDLL(network.Interface.HardwareAddr)
+}
+
+// lookupInterfaceForDUID finds the machine by DUID first, then by the link-layer
+// address embedded in the DUID.
+func lookupInterfaceForDUID(b *book.Book, duid dhcp6.DUID) *book.Interface {
+	if nic := b.LookupInterfaceForDUID(duid); nic != nil {
+		return nic
+	}
+	if hwaddr := duid.HardwareAddr(); hwaddr != nil {
+		return b.LookupInterfaceForHardwareAddr(hwaddr)
+	}
+	return nil
+}
+
+func (s *dhcp6Server) ServeDHCP6(req *dhcp6.Packet) *dhcp6.Packet {
+	book := s.parent.book()
+	network := book.V6Networks[s.network]
+	serverID := serverDUID(network)
+
+	clientID := dhcp6.DUID(req.Options.Get(dhcp6.OptionClientID))
+	if clientID == nil && req.Type != dhcp6.InformationRequest {
+		s.log().Warnf("%s without Client Identifier", req.Type)
+		return nil
+	}
+	switch req.Type {
+	case dhcp6.Request, dhcp6.Renew, dhcp6.Release, dhcp6.Decline:
+		if !bytes.Equal(req.Options.Get(dhcp6.OptionServerID), serverID) {
+			return nil // Message not for this dhcp server
+		}
+	case dhcp6.Solicit, dhcp6.Confirm, dhcp6.Rebind:
+		if req.Options.Has(dhcp6.OptionServerID) {
+			return nil // Must be discarded. See RFC 3315 15.2, 15.5, 15.7
+		}
+	}
+
+	// Setup options
+	var servOptions dhcp6.Options
+	if len(network.NameServerAddrs) > 0 && req.Options.Requested(dhcp6.OptionDNSServers) {
+		servOptions = append(servOptions, dhcp6.Option{
+			Code:  dhcp6.OptionDNSServers,
+			Value: dhcp6.JoinIPv6(shuffleIP(network.NameServerAddrs)),
+		})
+	}
+	if len(network.DomainSearch) > 0 && req.Options.Requested(dhcp6.OptionDomainList) {
+		servOptions = append(servOptions, dhcp6.Option{
+			Code:  dhcp6.OptionDomainList,
+			Value: encodeDomainList(network.DomainSearch),
+		})
+	}
+
+	if req.Type == dhcp6.InformationRequest {
+		s.log().Infof("InformationRequest from %x", []byte(clientID))
+		res := dhcp6.NewReply(req, dhcp6.Reply)
+		res.Options = append(res.Options, dhcp6.Option{Code: dhcp6.OptionServerID, Value: serverID})
+		res.Options = append(res.Options, servOptions...)
+		return res
+	}
+
+	var ipaddr net.IP
+	if nic := lookupInterfaceForDUID(book, clientID); nic != nil && nic.IPv6Addr != nil && network.Network.Contains(nic.IPv6Addr) {
+		ipaddr = nic.IPv6Addr
+	}
+	leaseDuration := time.Duration(float64(time.Hour) * 24 * network.LeaseDurationDays)
+	lifetime := uint32(leaseDuration / time.Second)
+
+	switch req.Type {
+	case dhcp6.Solicit, dhcp6.Request, dhcp6.Renew, dhcp6.Rebind:
+		if ipaddr == nil {
+			s.log().Errorf("Could not find address for %x (%s)", []byte(clientID), clientID.HardwareAddr())
+			if req.Type == dhcp6.Solicit {
+				return nil
+			}
+		}
+		mt := dhcp6.Reply
+		if req.Type == dhcp6.Solicit && !req.Options.Has(dhcp6.OptionRapidCommit) {
+			mt = dhcp6.Advertise
+		}
+		res := dhcp6.NewReply(req, mt)
+		res.Options = append(res.Options, dhcp6.Option{Code: dhcp6.OptionServerID, Value: serverID})
+		if req.Type == dhcp6.Solicit && mt == dhcp6.Reply {
+			res.Options = append(res.Options, dhcp6.Option{Code: dhcp6.OptionRapidCommit})
+		}
+		for _, value := range req.Options.All(dhcp6.OptionIANA) {
+			reqIA, err := dhcp6.ParseIANA(value)
+			if err != nil {
+				s.log().WithError(err).Warn("Invalid IA_NA")
+				continue
+			}
+			ia := &dhcp6.IANA{IAID: reqIA.IAID}
+			if ipaddr == nil && req.Type == dhcp6.Request {
+				ia.Options = dhcp6.Options{dhcp6.StatusCodeOption(dhcp6.StatusNoAddrsAvail, "no address for the client")}
+			} else if ipaddr == nil {
+				ia.Options = dhcp6.Options{dhcp6.StatusCodeOption(dhcp6.StatusNoBinding, "no binding for the client")}
+			} else {
+				ia.T1 = lifetime / 2
+				ia.T2 = lifetime / 5 * 4
+				addr := &dhcp6.IAAddr{
+					IP:                ipaddr,
+					PreferredLifetime: lifetime,
+					ValidLifetime:     lifetime,
+				}
+				ia.Options = dhcp6.Options{{Code: dhcp6.OptionIAAddr, Value: addr.Marshal()}}
+			}
+			res.Options = append(res.Options, dhcp6.Option{Code: dhcp6.OptionIANA, Value: ia.Marshal()})
+		}
+		res.Options = append(res.Options, servOptions...)
+		s.log().Infof(`%s from %x
+Replying %s:
+  ClientIP: %v
+  LeaseDuration: %v`,
+			req.Type, []byte(clientID),
+			mt,
+			ipaddr, leaseDuration)
+		return res
+
+	case dhcp6.Confirm:
+		status := dhcp6.StatusCodeOption(dhcp6.StatusSuccess, "")
+		for _, value := range req.Options.All(dhcp6.OptionIANA) {
+			ia, err := dhcp6.ParseIANA(value)
+			if err != nil {
+				continue
+			}
+			for _, addrValue := range ia.Options.All(dhcp6.OptionIAAddr) {
+				addr, err := dhcp6.ParseIAAddr(addrValue)
+				if err != nil || !network.Network.Contains(addr.IP) {
+					status = dhcp6.StatusCodeOption(dhcp6.StatusNotOnLink, "not on link")
+				}
+			}
+		}
+		res := dhcp6.NewReply(req, dhcp6.Reply)
+		res.Options = append(res.Options, dhcp6.Option{Code: dhcp6.OptionServerID, Value: serverID}, status)
+		return res
+
+	case dhcp6.Release, dhcp6.Decline:
+		// Nothing to do, but log.
+		s.log().Infof("%s from %x (assigned to %v)", req.Type, []byte(clientID), ipaddr)
+		res := dhcp6.NewReply(req, dhcp6.Reply)
+		res.Options = append(res.Options,
+			dhcp6.Option{Code: dhcp6.OptionServerID, Value: serverID},
+			dhcp6.StatusCodeOption(dhcp6.StatusSuccess, ""))
+		return res
+	default:
+		s.log().Errorf("Unknown Message: %d", req.Type)
+	}
+	return nil
+}
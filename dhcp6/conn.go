@@ -0,0 +1,57 @@
+package dhcp6
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv6"
+)
+
+// NewUDP6FilterListener listens on laddr, joins All_DHCP_Relay_Agents_and_Servers
+// on the interface, and filters packets not received by the interface.
+func NewUDP6FilterListener(interfaceName, laddr string) (c *serveIfConn, e error) {
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenPacket("udp6", laddr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e != nil {
+			l.Close()
+		}
+	}()
+	p := ipv6.NewPacketConn(l)
+	if err := p.JoinGroup(iface, &net.UDPAddr{IP: AllDHCPRelayAgentsAndServers}); err != nil {
+		return nil, err
+	}
+	if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		return nil, err
+	}
+	return &serveIfConn{ifIndex: iface.Index, conn: p}, nil
+}
+
+type serveIfConn struct {
+	ifIndex int
+	conn    *ipv6.PacketConn
+}
+
+func (s *serveIfConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	var cm *ipv6.ControlMessage
+	for { // Filter all other interfaces
+		n, cm, addr, err = s.conn.ReadFrom(b)
+		if err != nil || cm == nil || cm.IfIndex == s.ifIndex {
+			break
+		}
+	}
+	return
+}
+
+func (s *serveIfConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	// Clients use link-local addresses, so the interface must be specified.
+	cm := &ipv6.ControlMessage{IfIndex: s.ifIndex}
+	return s.conn.WriteTo(b, cm, addr)
+}
+
+func (s *serveIfConn) Close() error { return s.conn.Close() }
@@ -0,0 +1,341 @@
+// Package dhcp6 implements the subset of DHCPv6 (RFC 3315) which disq needs
+// to hand out statically assigned addresses.
+package dhcp6
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var (
+	ErrPacketTooShort = errors.New("dhcp6: packet too short")
+	ErrOptionTooShort = errors.New("dhcp6: option too short")
+)
+
+type MessageType byte
+
+const (
+	Solicit            MessageType = 1
+	Advertise          MessageType = 2
+	Request            MessageType = 3
+	Confirm            MessageType = 4
+	Renew              MessageType = 5
+	Rebind             MessageType = 6
+	Reply              MessageType = 7
+	Release            MessageType = 8
+	Decline            MessageType = 9
+	Reconfigure        MessageType = 10
+	InformationRequest MessageType = 11
+	RelayForw          MessageType = 12
+	RelayRepl          MessageType = 13
+)
+
+var messageTypeNames = map[MessageType]string{
+	Solicit:            "Solicit",
+	Advertise:          "Advertise",
+	Request:            "Request",
+	Confirm:            "Confirm",
+	Renew:              "Renew",
+	Rebind:             "Rebind",
+	Reply:              "Reply",
+	Release:            "Release",
+	Decline:            "Decline",
+	Reconfigure:        "Reconfigure",
+	InformationRequest: "InformationRequest",
+	RelayForw:          "RelayForw",
+	RelayRepl:          "RelayRepl",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+type OptionCode uint16
+
+const (
+	OptionClientID    OptionCode = 1
+	OptionServerID    OptionCode = 2
+	OptionIANA        OptionCode = 3
+	OptionIATA        OptionCode = 4
+	OptionIAAddr      OptionCode = 5
+	OptionORO         OptionCode = 6
+	OptionPreference  OptionCode = 7
+	OptionElapsedTime OptionCode = 8
+	OptionStatusCode  OptionCode = 13
+	OptionRapidCommit OptionCode = 14
+	OptionDNSServers  OptionCode = 23
+	OptionDomainList  OptionCode = 24
+)
+
+type StatusCode uint16
+
+const (
+	StatusSuccess      StatusCode = 0
+	StatusUnspecFail   StatusCode = 1
+	StatusNoAddrsAvail StatusCode = 2
+	StatusNoBinding    StatusCode = 3
+	StatusNotOnLink    StatusCode = 4
+	StatusUseMulticast StatusCode = 5
+)
+
+// Well known addresses and ports.
+var (
+	AllDHCPRelayAgentsAndServers = net.ParseIP("ff02::1:2")
+)
+
+const (
+	ClientPort = 546
+	ServerPort = 547
+)
+
+type Option struct {
+	Code  OptionCode
+	Value []byte
+}
+
+// Options keeps the order in the packet. Some options (ex: IA_NA) may appear
+// more than once.
+type Options []Option
+
+// Get returns the value of the first option with the code, or nil.
+func (o Options) Get(code OptionCode) []byte {
+	for _, opt := range o {
+		if opt.Code == code {
+			return opt.Value
+		}
+	}
+	return nil
+}
+
+func (o Options) Has(code OptionCode) bool {
+	for _, opt := range o {
+		if opt.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// All returns the values of all options with the code.
+func (o Options) All(code OptionCode) [][]byte {
+	var values [][]byte
+	for _, opt := range o {
+		if opt.Code == code {
+			values = append(values, opt.Value)
+		}
+	}
+	return values
+}
+
+// Requested returns true if the option is listed in the Option Request
+// Option, or the client did not send ORO.
+func (o Options) Requested(code OptionCode) bool {
+	oro := o.Get(OptionORO)
+	if oro == nil {
+		return true
+	}
+	for i := 0; i+1 < len(oro); i += 2 {
+		if OptionCode(binary.BigEndian.Uint16(oro[i:])) == code {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseOptions(b []byte) (Options, error) {
+	var opts Options
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrOptionTooShort
+		}
+		code := OptionCode(binary.BigEndian.Uint16(b[0:2]))
+		size := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+size {
+			return nil, ErrOptionTooShort
+		}
+		opts = append(opts, Option{Code: code, Value: b[4 : 4+size]})
+		b = b[4+size:]
+	}
+	return opts, nil
+}
+
+func (o Options) Marshal() []byte {
+	size := 0
+	for _, opt := range o {
+		size += 4 + len(opt.Value)
+	}
+	b := make([]byte, 0, size)
+	for _, opt := range o {
+		var hdr [4]byte
+		binary.BigEndian.PutUint16(hdr[0:2], uint16(opt.Code))
+		binary.BigEndian.PutUint16(hdr[2:4], uint16(len(opt.Value)))
+		b = append(b, hdr[:]...)
+		b = append(b, opt.Value...)
+	}
+	return b
+}
+
+// Packet is a client/server message. Relay messages are not supported.
+type Packet struct {
+	Type          MessageType
+	TransactionID [3]byte
+	Options       Options
+}
+
+func Parse(b []byte) (*Packet, error) {
+	if len(b) < 4 {
+		return nil, ErrPacketTooShort
+	}
+	opts, err := ParseOptions(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	p := &Packet{
+		Type:    MessageType(b[0]),
+		Options: opts,
+	}
+	copy(p.TransactionID[:], b[1:4])
+	return p, nil
+}
+
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, 4, 512)
+	b[0] = byte(p.Type)
+	copy(b[1:4], p.TransactionID[:])
+	return append(b, p.Options.Marshal()...)
+}
+
+// NewReply makes a reply for the request, copying its transaction id and
+// client identifier.
+func NewReply(req *Packet, mt MessageType) *Packet {
+	p := &Packet{
+		Type:          mt,
+		TransactionID: req.TransactionID,
+	}
+	if clientID := req.Options.Get(OptionClientID); clientID != nil {
+		p.Options = append(p.Options, Option{Code: OptionClientID, Value: clientID})
+	}
+	return p
+}
+
+// IANA is an Identity Association for Non-temporary Addresses.
+type IANA struct {
+	IAID    [4]byte
+	T1      uint32
+	T2      uint32
+	Options Options
+}
+
+func ParseIANA(b []byte) (*IANA, error) {
+	if len(b) < 12 {
+		return nil, ErrOptionTooShort
+	}
+	opts, err := ParseOptions(b[12:])
+	if err != nil {
+		return nil, err
+	}
+	ia := &IANA{
+		T1:      binary.BigEndian.Uint32(b[4:8]),
+		T2:      binary.BigEndian.Uint32(b[8:12]),
+		Options: opts,
+	}
+	copy(ia.IAID[:], b[0:4])
+	return ia, nil
+}
+
+func (ia *IANA) Marshal() []byte {
+	b := make([]byte, 12)
+	copy(b[0:4], ia.IAID[:])
+	binary.BigEndian.PutUint32(b[4:8], ia.T1)
+	binary.BigEndian.PutUint32(b[8:12], ia.T2)
+	return append(b, ia.Options.Marshal()...)
+}
+
+type IAAddr struct {
+	IP                net.IP
+	PreferredLifetime uint32
+	ValidLifetime     uint32
+	Options           Options
+}
+
+func ParseIAAddr(b []byte) (*IAAddr, error) {
+	if len(b) < 24 {
+		return nil, ErrOptionTooShort
+	}
+	opts, err := ParseOptions(b[24:])
+	if err != nil {
+		return nil, err
+	}
+	return &IAAddr{
+		IP:                net.IP(b[0:16]),
+		PreferredLifetime: binary.BigEndian.Uint32(b[16:20]),
+		ValidLifetime:     binary.BigEndian.Uint32(b[20:24]),
+		Options:           opts,
+	}, nil
+}
+
+func (a *IAAddr) Marshal() []byte {
+	b := make([]byte, 24)
+	copy(b[0:16], a.IP.To16())
+	binary.BigEndian.PutUint32(b[16:20], a.PreferredLifetime)
+	binary.BigEndian.PutUint32(b[20:24], a.ValidLifetime)
+	return append(b, a.Options.Marshal()...)
+}
+
+func StatusCodeOption(code StatusCode, msg string) Option {
+	b := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return Option{Code: OptionStatusCode, Value: append(b, msg...)}
+}
+
+// DUID is a DHCP Unique Identifier.
+type DUID []byte
+
+const (
+	DUIDTypeLLT = 1
+	DUIDTypeEN  = 2
+	DUIDTypeLL  = 3
+)
+
+const hardwareTypeEthernet = 1
+
+// NewDUIDLL makes a DUID based on the link-layer address.
+func NewDUIDLL(hwaddr net.HardwareAddr) DUID {
+	d := make(DUID, 4, 4+len(hwaddr))
+	binary.BigEndian.PutUint16(d[0:2], DUIDTypeLL)
+	binary.BigEndian.PutUint16(d[2:4], hardwareTypeEthernet)
+	return append(d, hwaddr...)
+}
+
+// HardwareAddr returns the link-layer address in DUID-LLT or DUID-LL,
+// or nil for other types of DUID.
+func (d DUID) HardwareAddr() net.HardwareAddr {
+	if len(d) < 2 {
+		return nil
+	}
+	switch binary.BigEndian.Uint16(d[0:2]) {
+	case DUIDTypeLLT:
+		if len(d) > 8 {
+			return net.HardwareAddr(d[8:])
+		}
+	case DUIDTypeLL:
+		if len(d) > 4 {
+			return net.HardwareAddr(d[4:])
+		}
+	}
+	return nil
+}
+
+// JoinIPv6 makes the value of options with a list of addresses,
+// such as OptionDNSServers.
+func JoinIPv6(ips []net.IP) []byte {
+	b := make([]byte, 0, len(ips)*net.IPv6len)
+	for _, ip := range ips {
+		b = append(b, ip.To16()...)
+	}
+	return b
+}
@@ -0,0 +1,86 @@
+package dhcp6
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	ia := &IANA{
+		IAID: [4]byte{1, 2, 3, 4},
+		T1:   100,
+		T2:   200,
+		Options: Options{
+			{Code: OptionIAAddr, Value: (&IAAddr{IP: net.ParseIP("fd00::2"), PreferredLifetime: 300, ValidLifetime: 400}).Marshal()},
+		},
+	}
+	p := &Packet{
+		Type:          Solicit,
+		TransactionID: [3]byte{0xaa, 0xbb, 0xcc},
+		Options: Options{
+			{Code: OptionClientID, Value: NewDUIDLL(net.HardwareAddr{0x72, 0, 7, 0xef, 0x42, 0x80})},
+			{Code: OptionIANA, Value: ia.Marshal()},
+			{Code: OptionRapidCommit},
+		},
+	}
+	parsed, err := Parse(p.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Type != Solicit || parsed.TransactionID != p.TransactionID || len(parsed.Options) != 3 {
+		t.Fatalf("Unexpected packet: %+v", parsed)
+	}
+	if !parsed.Options.Has(OptionRapidCommit) {
+		t.Errorf("Rapid Commit option is lost")
+	}
+	parsedIA, err := ParseIANA(parsed.Options.Get(OptionIANA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedIA.IAID != ia.IAID || parsedIA.T1 != 100 || parsedIA.T2 != 200 {
+		t.Errorf("Unexpected IA_NA: %+v", parsedIA)
+	}
+	addr, err := ParseIAAddr(parsedIA.Options.Get(OptionIAAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(net.ParseIP("fd00::2")) || addr.PreferredLifetime != 300 || addr.ValidLifetime != 400 {
+		t.Errorf("Unexpected IAADDR: %+v", addr)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	if _, err := Parse([]byte{1, 2, 3}); err == nil {
+		t.Error("Too short packet must be rejected")
+	}
+	if _, err := Parse([]byte{1, 2, 3, 4, 0, 1, 0, 10, 1}); err == nil {
+		t.Error("Truncated option must be rejected")
+	}
+}
+
+func TestDUIDHardwareAddr(t *testing.T) {
+	hwaddr := net.HardwareAddr{0x72, 0, 7, 0xef, 0x42, 0x80}
+	if actual := NewDUIDLL(hwaddr).HardwareAddr(); !bytes.Equal(actual, hwaddr) {
+		t.Errorf("DUID-LL: expected %s, got %s", hwaddr, actual)
+	}
+	llt := DUID{0, 1, 0, 1, 0x1f, 0x2e, 0x3d, 0x4c, 0x72, 0, 7, 0xef, 0x42, 0x80}
+	if actual := llt.HardwareAddr(); !bytes.Equal(actual, hwaddr) {
+		t.Errorf("DUID-LLT: expected %s, got %s", hwaddr, actual)
+	}
+	en := DUID{0, 2, 0, 0, 0x30, 0x39, 1, 2, 3}
+	if actual := en.HardwareAddr(); actual != nil {
+		t.Errorf("DUID-EN has no hardware address, got %s", actual)
+	}
+}
+
+func TestRequested(t *testing.T) {
+	var opts Options
+	if !opts.Requested(OptionDNSServers) {
+		t.Error("Every option is requested without ORO")
+	}
+	opts = Options{{Code: OptionORO, Value: []byte{0, 24}}}
+	if opts.Requested(OptionDNSServers) || !opts.Requested(OptionDomainList) {
+		t.Error("Only options in ORO are requested")
+	}
+}
@@ -0,0 +1,45 @@
+package dhcp6
+
+import (
+	"net"
+)
+
+type Handler interface {
+	ServeDHCP6(req *Packet) *Packet
+}
+
+// ServeConn is the bare minimum connection functions required by Serve().
+// It is the same as the one of github.com/krolaw/dhcp4, so that fake
+// connections can be used in tests.
+type ServeConn interface {
+	ReadFrom(b []byte) (n int, addr net.Addr, err error)
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+}
+
+// Serve reads packets from the conn and passes them to the handler,
+// until ReadFrom or WriteTo fails. Replies are sent back to where the
+// request came from.
+func Serve(conn ServeConn, handler Handler) error {
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		req, err := Parse(buffer[:n])
+		if err != nil {
+			continue
+		}
+		switch req.Type {
+		case Solicit, Request, Confirm, Renew, Rebind, Release, Decline, InformationRequest:
+		default:
+			// Relay and server messages are not for us.
+			continue
+		}
+		if res := handler.ServeDHCP6(req); res != nil {
+			if _, err := conn.WriteTo(res.Marshal(), addr); err != nil {
+				return err
+			}
+		}
+	}
+}
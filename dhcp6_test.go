@@ -0,0 +1,173 @@
+package disq
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ledyba/disq/book"
+	"github.com/ledyba/disq/dhcp6"
+)
+
+// fakeDHCP6Conn passes packets through channels instead of the network.
+type fakeDHCP6Conn struct {
+	in  chan []byte
+	out chan []byte
+}
+
+var errFakeConnClosed = errors.New("closed")
+
+func newFakeDHCP6Conn() *fakeDHCP6Conn {
+	return &fakeDHCP6Conn{
+		in:  make(chan []byte),
+		out: make(chan []byte, 1),
+	}
+}
+
+func (c *fakeDHCP6Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p, ok := <-c.in
+	if !ok {
+		return 0, nil, errFakeConnClosed
+	}
+	return copy(b, p), &net.UDPAddr{IP: net.ParseIP("fe80::7000:7ff:feef:4280"), Port: dhcp6.ClientPort}, nil
+}
+
+func (c *fakeDHCP6Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (c *fakeDHCP6Conn) Close() error {
+	close(c.in)
+	return nil
+}
+
+// exchange sends the packet and returns the reply, or nil.
+func (c *fakeDHCP6Conn) exchange(t *testing.T, p *dhcp6.Packet) *dhcp6.Packet {
+	c.in <- p.Marshal()
+	// Serve handles packets one by one, so the next read means the previous
+	// packet is done.
+	c.in <- (&dhcp6.Packet{Type: dhcp6.Reply}).Marshal()
+	select {
+	case b := <-c.out:
+		res, err := dhcp6.Parse(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	default:
+		return nil
+	}
+}
+
+func newTestDHCP6Server(t *testing.T) (*dhcp6Server, *fakeDHCP6Conn) {
+	s := newTestServer(t)
+	_, network, _ := net.ParseCIDR("fd00::/64")
+	s.book().V6Networks = map[string]*book.V6Network{
+		"loopback": {
+			Name: "loopback",
+			Interface: &net.Interface{
+				Name:         "lo",
+				HardwareAddr: net.HardwareAddr{0x72, 0, 7, 0xef, 0, 1},
+			},
+			Network:           network,
+			NameServerAddrs:   []net.IP{net.ParseIP("fd00::53")},
+			DomainSearch:      []string{"eagle-jump."},
+			LeaseDurationDays: 1.0,
+		},
+	}
+	ds := newDHCP6Server(s, "loopback")
+	c := newFakeDHCP6Conn()
+	go dhcp6.Serve(c, ds)
+	return ds, c
+}
+
+func newSolicit(hwaddr string) *dhcp6.Packet {
+	mac, _ := net.ParseMAC(hwaddr)
+	ia := &dhcp6.IANA{IAID: [4]byte{0, 0, 0, 1}}
+	return &dhcp6.Packet{
+		Type:          dhcp6.Solicit,
+		TransactionID: [3]byte{1, 2, 3},
+		Options: dhcp6.Options{
+			{Code: dhcp6.OptionClientID, Value: dhcp6.NewDUIDLL(mac)},
+			{Code: dhcp6.OptionIANA, Value: ia.Marshal()},
+		},
+	}
+}
+
+func assignedAddr(t *testing.T, p *dhcp6.Packet) net.IP {
+	ia, err := dhcp6.ParseIANA(p.Options.Get(dhcp6.OptionIANA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := dhcp6.ParseIAAddr(ia.Options.Get(dhcp6.OptionIAAddr))
+	if err != nil {
+		t.Fatalf("No address assigned: %v", ia.Options)
+	}
+	return addr.IP
+}
+
+func TestDHCP6SolicitAndRequest(t *testing.T) {
+	_, c := newTestDHCP6Server(t)
+	defer c.Close()
+
+	solicit := newSolicit("72:00:07:ef:42:80")
+	adv := c.exchange(t, solicit)
+	if adv == nil || adv.Type != dhcp6.Advertise || adv.TransactionID != solicit.TransactionID {
+		t.Fatalf("Expected Advertise, got %+v", adv)
+	}
+	if ip := assignedAddr(t, adv); !ip.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("Expected fd00::2, got %v", ip)
+	}
+	if adv.Options.Get(dhcp6.OptionDNSServers) == nil || adv.Options.Get(dhcp6.OptionDomainList) == nil {
+		t.Errorf("DNS servers and domain list must be advertised: %v", adv.Options)
+	}
+
+	request := &dhcp6.Packet{
+		Type:          dhcp6.Request,
+		TransactionID: [3]byte{4, 5, 6},
+		Options: dhcp6.Options{
+			{Code: dhcp6.OptionClientID, Value: solicit.Options.Get(dhcp6.OptionClientID)},
+			{Code: dhcp6.OptionServerID, Value: adv.Options.Get(dhcp6.OptionServerID)},
+			{Code: dhcp6.OptionIANA, Value: solicit.Options.Get(dhcp6.OptionIANA)},
+		},
+	}
+	reply := c.exchange(t, request)
+	if reply == nil || reply.Type != dhcp6.Reply {
+		t.Fatalf("Expected Reply, got %+v", reply)
+	}
+	if ip := assignedAddr(t, reply); !ip.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("Expected fd00::2, got %v", ip)
+	}
+
+	// Request for another server must be ignored.
+	request.Options[1].Value = dhcp6.NewDUIDLL(net.HardwareAddr{1, 2, 3, 4, 5, 6})
+	if reply := c.exchange(t, request); reply != nil {
+		t.Errorf("Request for another server was answered: %+v", reply)
+	}
+}
+
+func TestDHCP6RapidCommit(t *testing.T) {
+	_, c := newTestDHCP6Server(t)
+	defer c.Close()
+
+	solicit := newSolicit("72:00:07:ef:42:80")
+	solicit.Options = append(solicit.Options, dhcp6.Option{Code: dhcp6.OptionRapidCommit})
+	reply := c.exchange(t, solicit)
+	if reply == nil || reply.Type != dhcp6.Reply || !reply.Options.Has(dhcp6.OptionRapidCommit) {
+		t.Fatalf("Expected Reply with Rapid Commit, got %+v", reply)
+	}
+}
+
+func TestDHCP6UnknownClient(t *testing.T) {
+	_, c := newTestDHCP6Server(t)
+	defer c.Close()
+
+	// yagami has no IPv6 address.
+	if reply := c.exchange(t, newSolicit("72:00:07:ef:42:81")); reply != nil {
+		t.Errorf("Solicit from a machine without IPv6 address was answered: %+v", reply)
+	}
+	if reply := c.exchange(t, newSolicit("72:00:07:ff:ff:ff")); reply != nil {
+		t.Errorf("Solicit from an unknown machine was answered: %+v", reply)
+	}
+}
@@ -0,0 +1,22 @@
+package disq
+
+import (
+	"strings"
+)
+
+// encodeDomainList encodes names in the uncompressed form of RFC 1035,
+// used by Domain Search options of DHCPv4 (RFC 3397) and DHCPv6 (RFC 3646).
+func encodeDomainList(names []string) []byte {
+	var b []byte
+	for _, name := range names {
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			if len(label) == 0 {
+				continue
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		b = append(b, 0)
+	}
+	return b
+}
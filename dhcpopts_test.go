@@ -0,0 +1,13 @@
+package disq
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDomainList(t *testing.T) {
+	expected := []byte("\x0aeagle-jump\x00\x03dev\x0aeagle-jump\x00")
+	if actual := encodeDomainList([]string{"eagle-jump.", "dev.eagle-jump"}); !bytes.Equal(actual, expected) {
+		t.Errorf("Expected %q, got %q", expected, actual)
+	}
+}
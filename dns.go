@@ -5,7 +5,12 @@ import (
 
 	"net"
 
+	"strconv"
+	"strings"
+	"sync/atomic"
+
 	log "github.com/Sirupsen/logrus"
+	"github.com/ledyba/disq/book"
 	"github.com/miekg/dns"
 )
 
@@ -15,19 +20,142 @@ func newReply(r *dns.Msg) *dns.Msg {
 	return m
 }
 
+// reverseIPv4 parses "d.c.b.a.in-addr.arpa." and returns a.b.c.d.
+// It returns nil if the name is not a reverse name of an IPv4 address.
+func reverseIPv4(name string) net.IP {
+	const suffix = ".in-addr.arpa."
+	if !strings.HasSuffix(strings.ToLower(name), suffix) {
+		return nil
+	}
+	labels := strings.Split(name[:len(name)-len(suffix)], ".")
+	if len(labels) != net.IPv4len {
+		return nil
+	}
+	ip := make(net.IP, net.IPv4len)
+	for i, label := range labels {
+		b, err := strconv.ParseUint(label, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[net.IPv4len-1-i] = byte(b)
+	}
+	return ip
+}
+
+func replyError(r *dns.Msg, rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	return m
+}
+
+// appendAnswer parses the record and appends it to the answer section.
+func appendAnswer(m *dns.Msg, resp string) error {
+	log.WithField("Module", "DNS").Debug(resp)
+	rr, err := dns.NewRR(resp)
+	if err != nil {
+		return err
+	}
+	m.Answer = append(m.Answer, rr)
+	return nil
+}
+
+// ednsUDPSize is the size of the buffer which disq advertises.
+const ednsUDPSize = 4096
+
+// clientSubnet returns EDNS Client Subnet option in the message, or nil.
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// setEdns0 replaces the OPT record in the reply with ours, when the client
+// sent one. See RFC 6891.
+func setEdns0(r, m *dns.Msg) {
+	extra := make([]dns.RR, 0, len(m.Extra))
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	m.SetEdns0(ednsUDPSize, opt.Do())
+	if ecs := clientSubnet(r); ecs != nil {
+		// Our answers are the same for all clients. See RFC 7871 7.2.1.
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			SourceScope:   0,
+			Address:       ecs.Address,
+		})
+	}
+}
+
+// udpSize returns the size of the buffer which the client advertised.
+func udpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// ServeDNS writes exactly one reply for every request.
 func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := s.answer(w, r)
+	setEdns0(r, m)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		// Sets TC bit if the answer does not fit, so that the client retries over TCP.
+		m.Truncate(udpSize(r))
+	}
+	err := w.WriteMsg(m)
+	if err != nil {
+		log.WithField("Module", "DNS").WithError(err).Warnf("Failed to reply to %s", w.RemoteAddr().String())
+	}
+}
+
+func (s *Server) answer(w dns.ResponseWriter, r *dns.Msg) *dns.Msg {
 	var err error
 	b := s.book()
-	remote := w.RemoteAddr().(*net.UDPAddr)
-	if remote == nil {
+	ip := remoteIP(w.RemoteAddr())
+	if ip == nil {
 		err = fmt.Errorf("unknown request from %s -> %s", w.RemoteAddr().String(), w.LocalAddr().String())
 		log.WithField("Module", "DNS").WithError(err).Error()
 		s.ErrorStream <- &DNSError{Err: err}
-		return
+		return replyError(r, dns.RcodeRefused)
+	}
+	if ecs := clientSubnet(r); ecs != nil && b.DNS.IsClientSubnetProxy(ip) {
+		log.WithField("Module", "DNS").Debugf("Request from %s on behalf of %s", ip, ecs.Address)
+		ip = ecs.Address
 	}
 	allowed := false
 	for _, network := range b.DNS.Networks {
-		if b.V4Networks[network].Network.Contains(remote.IP) {
+		if n, ok := b.V4Networks[network]; ok && n.Network.Contains(ip) {
+			allowed = true
+			break
+		}
+		if n, ok := b.V6Networks[network]; ok && n.Network.Contains(ip) {
 			allowed = true
 			break
 		}
@@ -35,53 +163,15 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	if !allowed {
 		err = fmt.Errorf("unauthorized request from %s -> %s", w.RemoteAddr().String(), w.LocalAddr().String())
 		log.WithField("Module", "DNS").WithError(err).Warn()
-		return
+		return replyError(r, dns.RcodeRefused)
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		log.WithField("Module", "DNS").Warnf("Unsupported EDNS version: %d", opt.Version())
+		return replyError(r, dns.RcodeBadVers)
 	}
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		m := newReply(r)
-		for _, q := range r.Question {
-			switch q.Qtype {
-			case dns.TypeA:
-				if ipaddr := b.LookupIPForFQDN(q.Name); ipaddr != nil {
-					// This host is in our datacenter.
-					ans := ipaddr.String()
-					resp := fmt.Sprintf("%s %d A %s", q.Name, b.DNS.LocalTTL, ans)
-					log.WithField("Module", "DNS").Debugf(resp)
-					rr, err := dns.NewRR(resp)
-					if err != nil {
-						log.WithField("Module", "DNS").WithError(err).Error("[BUG] Error when creating DNS response")
-						return
-					}
-					m.Answer = append(m.Answer, rr)
-				} else {
-					// Host in the outside.
-					addrs, err := net.LookupIP(q.Name)
-					if err != nil {
-						log.WithField("Module", "DNS").WithError(err).Warnf("Not found: %s", q.Name)
-						break
-					}
-					for _, ipaddr = range addrs {
-						// LookupIP returns both v4 and v6 addrs.
-						ipaddr = ipaddr.To4()
-						if ipaddr == nil {
-							continue
-						}
-						resp := fmt.Sprintf("%s %d A %s", q.Name, b.DNS.GlobalTTL, ipaddr.String())
-						log.WithField("Module", "DNS").Debug(resp)
-						rr, err := dns.NewRR(resp)
-						m.Answer = append(m.Answer, rr)
-						if err != nil {
-							log.WithField("Module", "DNS").WithError(err).Error("[BUG] Error when creating DNS response")
-							return
-						}
-					}
-				}
-			default:
-				log.Warn("Unsupported query: ", q.String())
-			}
-		}
-		w.WriteMsg(m)
+		return s.answerQuery(r)
 	case dns.OpcodeIQuery:
 		log.WithField("Module", "DNS").Warn("IQuery was questioned, but it is obsoleted. See: https://tools.ietf.org/rfc/rfc3425.txt")
 	case dns.OpcodeStatus:
@@ -90,5 +180,184 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		log.WithField("Module", "DNS").Info("Can't answer Notify questions.")
 	case dns.OpcodeUpdate:
 		log.WithField("Module", "DNS").Info("Can't answer Update questions.")
+	default:
+		log.WithField("Module", "DNS").Infof("Unknown opcode: %d", r.Opcode)
+	}
+	return replyError(r, dns.RcodeNotImplemented)
+}
+
+// withOwner copies the record from the book, with the name as the question
+// was written. Names in the book are all lowercase.
+func withOwner(rr dns.RR, name string) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
+}
+
+// rotate returns the addresses starting from the next one of the last query,
+// so that the load is balanced among the machines sharing a name.
+func (s *Server) rotate(ips []net.IP) []net.IP {
+	if len(ips) <= 1 {
+		return ips
+	}
+	start := int(atomic.AddUint32(&s.rotation, 1) % uint32(len(ips)))
+	rotated := make([]net.IP, 0, len(ips))
+	rotated = append(rotated, ips[start:]...)
+	return append(rotated, ips[:start]...)
+}
+
+// maxCNAMEChain limits the length of aliases to follow.
+const maxCNAMEChain = 8
+
+// negativeSOARecord returns SOA record for the authority section of
+// negative answers. See RFC 2308: its TTL is the minimum of the SOA's TTL
+// and the MINIMUM field.
+func negativeSOARecord(zone *book.Zone, ttl int) dns.RR {
+	if uint32(ttl) > zone.NegativeTTL {
+		ttl = int(zone.NegativeTTL)
+	}
+	return soaRecord(zone, ttl)
+}
+
+func soaRecord(zone *book.Zone, ttl int) dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone.Name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(ttl),
+		},
+		Ns:      zone.NameServers[0],
+		Mbox:    zone.Hostmaster,
+		Serial:  zone.Serial,
+		Refresh: zone.Refresh,
+		Retry:   zone.Retry,
+		Expire:  zone.Expire,
+		Minttl:  zone.NegativeTTL,
+	}
+}
+
+func (s *Server) answerQuery(r *dns.Msg) *dns.Msg {
+	var err error
+	b := s.book()
+	if len(r.Question) != 1 {
+		log.WithField("Module", "DNS").Warnf("Can't answer %d questions at once.", len(r.Question))
+		return replyError(r, dns.RcodeFormatError)
+	}
+	q := r.Question[0]
+	m := newReply(r)
+	zone := b.LookupZone(q.Name)
+	local := false
+	// Follow aliases in the book. Names out of the book are left to the client.
+	name := q.Name
+	for i := 0; i < maxCNAMEChain && q.Qtype != dns.TypeCNAME; i++ {
+		cname := b.LookupCNAME(name)
+		if cname == nil {
+			break
+		}
+		local = true
+		m.Answer = append(m.Answer, withOwner(cname, name))
+		name = cname.Target
+	}
+	switch q.Qtype {
+	case dns.TypeA:
+		if ipaddrs := b.LookupIPsForFQDN(name); len(ipaddrs) > 0 {
+			// This host is in our datacenter.
+			local = true
+			for _, ipaddr := range s.rotate(ipaddrs) {
+				err = appendAnswer(m, fmt.Sprintf("%s %d A %s", name, b.DNS.LocalTTL, ipaddr.String()))
+				if err != nil {
+					break
+				}
+			}
+		}
+	case dns.TypeAAAA:
+		if ipaddrs := b.LookupIPv6sForFQDN(name); len(ipaddrs) > 0 {
+			// This host is in our datacenter.
+			local = true
+			for _, ipaddr := range s.rotate(ipaddrs) {
+				err = appendAnswer(m, fmt.Sprintf("%s %d AAAA %s", name, b.DNS.LocalTTL, ipaddr.String()))
+				if err != nil {
+					break
+				}
+			}
+		} else if nics := b.LookupInterfacesForFQDN(name); len(nics) > 0 && zone == nil {
+			// Without IPv6 address, the answer is empty (NODATA).
+			local = true
+		}
+	case dns.TypePTR:
+		if ipaddr := reverseIPv4(q.Name); ipaddr != nil && b.LookupV4NetworkForIP(ipaddr) != nil {
+			// This address is in our datacenter.
+			local = true
+			m.Authoritative = true
+			nic := b.LookupInterfaceForIP(ipaddr)
+			if nic == nil || len(nic.Fqdn) == 0 {
+				log.WithField("Module", "DNS").Warnf("Not found: %s", q.Name)
+				m.Rcode = dns.RcodeNameError
+				break
+			}
+			err = appendAnswer(m, fmt.Sprintf("%s %d PTR %s", q.Name, b.DNS.LocalTTL, nic.Fqdn))
+		}
+	case dns.TypeSOA:
+		if zone != nil && strings.EqualFold(zone.Name, q.Name) {
+			local = true
+			m.Answer = append(m.Answer, withOwner(soaRecord(zone, b.DNS.LocalTTL), q.Name))
+		}
+	case dns.TypeNS:
+		if zone != nil && strings.EqualFold(zone.Name, q.Name) {
+			local = true
+			for _, ns := range zone.NameServers {
+				err = appendAnswer(m, fmt.Sprintf("%s %d NS %s", q.Name, b.DNS.LocalTTL, ns))
+				if err != nil {
+					break
+				}
+				if ipaddr := b.LookupIPForFQDN(ns); ipaddr != nil {
+					// Glue
+					m.Extra = append(m.Extra, &dns.A{
+						Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(b.DNS.LocalTTL)},
+						A:   ipaddr,
+					})
+				}
+			}
+		}
+	default:
+		if rrs := b.LookupRecords(name, q.Qtype); len(rrs) > 0 {
+			local = true
+			for _, rr := range rrs {
+				m.Answer = append(m.Answer, withOwner(rr, name))
+			}
+		}
+	}
+	if err != nil {
+		log.WithField("Module", "DNS").WithError(err).Error("[BUG] Error when creating DNS response")
+		return replyError(r, dns.RcodeServerFailure)
+	}
+	if zone != nil {
+		// We are authoritative for this name. Never forward it.
+		m.Authoritative = true
+		if !local {
+			if !b.NameExists(q.Name) && len(b.LookupInterfacesForFQDN(q.Name)) == 0 {
+				log.WithField("Module", "DNS").Warnf("Not found: %s", q.Name)
+				m.Rcode = dns.RcodeNameError
+			}
+			m.Ns = append(m.Ns, negativeSOARecord(zone, b.DNS.LocalTTL))
+		}
+		return m
 	}
+	if local {
+		return m
+	}
+
+	// Host in the outside.
+	m, err = s.resolve(r)
+	if err == ErrNoUpstreams {
+		// We can't say the name does not exist, without being authoritative for it.
+		log.WithField("Module", "DNS").Warnf("No upstreams to resolve: %s", q.Name)
+		return replyError(r, dns.RcodeServerFailure)
+	}
+	if err != nil {
+		log.WithField("Module", "DNS").WithError(err).Warnf("Failed to forward: %s", q.String())
+		return replyError(r, dns.RcodeServerFailure)
+	}
+	return m
 }
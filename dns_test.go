@@ -5,8 +5,14 @@ import (
 
 	"time"
 
+	"bytes"
+	"net"
+
 	"github.com/Sirupsen/logrus"
+	"github.com/ledyba/disq/book"
 	"github.com/ledyba/disq/book-test"
+	"github.com/ledyba/disq/conf"
+	"github.com/ledyba/disq/util-test"
 	"github.com/miekg/dns"
 )
 
@@ -14,6 +20,74 @@ func init() {
 	logrus.SetLevel(logrus.FatalLevel)
 }
 
+// testResponseWriter records replies instead of sending them.
+type testResponseWriter struct {
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *testResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+// newTestServer makes a server from config-sample.json without touching
+// the interfaces of the host running the test.
+func newTestServer(t *testing.T) *Server {
+	c, err := conf.Load(util_test.ReadAll(t, "./config-sample.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestServerFromConfig(t, c)
+}
+
+func newTestServerFromConfig(t *testing.T, c *conf.Config) *Server {
+	c.DNS.Networks = nil
+	c.V4Networks = nil
+	c.V6Networks = nil
+	b, err := book.FromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, network, _ := net.ParseCIDR("127.0.0.0/24")
+	b.V4Networks = map[string]*book.V4Network{
+		"loopback": {
+			Name:    "loopback",
+			Network: network,
+		},
+	}
+	b.DNS.Networks = []string{"loopback"}
+	return FromBook(b)
+}
+
+func query(t *testing.T, s *Server, name string, qtype uint16) *dns.Msg {
+	w := &testResponseWriter{
+		remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345},
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	s.ServeDNS(w, m)
+	if len(w.msgs) != 1 {
+		t.Fatalf("Expected exactly one reply for %s, got %d", name, len(w.msgs))
+	}
+	return w.msgs[0]
+}
+
 func BenchmarkDNS(b *testing.B) {
 	var err error
 	b.ResetTimer()
@@ -48,3 +122,399 @@ func BenchmarkDNS(b *testing.B) {
 	}
 
 }
+
+func TestReverseIPv4(t *testing.T) {
+	cases := map[string]net.IP{
+		"2.0.0.127.in-addr.arpa.":   net.IPv4(127, 0, 0, 2).To4(),
+		"4.3.2.1.IN-ADDR.ARPA.":     net.IPv4(1, 2, 3, 4).To4(),
+		"3.2.1.in-addr.arpa.":       nil,
+		"256.0.0.127.in-addr.arpa.": nil,
+		"aoba.eagle-jump.":          nil,
+	}
+	for name, expected := range cases {
+		if actual := reverseIPv4(name); !bytes.Equal(actual, expected) {
+			t.Errorf("reverseIPv4(%s): expected %v, got %v", name, expected, actual)
+		}
+	}
+}
+
+func TestPTR(t *testing.T) {
+	s := newTestServer(t)
+
+	r := query(t, s, "2.0.0.127.in-addr.arpa.", dns.TypePTR)
+	if !r.Authoritative || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("Unexpected reply: %v", r)
+	}
+	if ptr, ok := r.Answer[0].(*dns.PTR); !ok || ptr.Ptr != "aoba.eagle-jump." || ptr.Hdr.Ttl != 600 {
+		t.Errorf("Unexpected answer: %v", r.Answer[0])
+	}
+
+	r = query(t, s, "200.0.0.127.in-addr.arpa.", dns.TypePTR)
+	if !r.Authoritative || r.Rcode != dns.RcodeNameError {
+		t.Errorf("Unexpected reply: %v", r)
+	}
+}
+
+func TestAAAA(t *testing.T) {
+	s := newTestServer(t)
+
+	r := query(t, s, "aoba.eagle-jump.", dns.TypeAAAA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("Unexpected reply: %v", r)
+	}
+	if aaaa, ok := r.Answer[0].(*dns.AAAA); !ok || !aaaa.AAAA.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("Unexpected answer: %v", r.Answer[0])
+	}
+
+	// yagami has no IPv6 address.
+	r = query(t, s, "yagami.eagle-jump.", dns.TypeAAAA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("Expected NODATA, got: %v", r)
+	}
+}
+
+func TestRcode(t *testing.T) {
+	s := newTestServer(t)
+	s.book().DNS.Upstreams = nil
+
+	r := query(t, s, "nosuch.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL without upstreams, got %s", dns.RcodeToString[r.Rcode])
+	}
+	r = query(t, s, "nosuch.eagle-jump.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN in the zone, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	for _, opcode := range []int{dns.OpcodeIQuery, dns.OpcodeStatus, dns.OpcodeNotify, dns.OpcodeUpdate} {
+		w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}}
+		m := new(dns.Msg)
+		m.SetQuestion("aoba.eagle-jump.", dns.TypeA)
+		m.Opcode = opcode
+		s.ServeDNS(w, m)
+		if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeNotImplemented {
+			t.Errorf("Expected NOTIMP for %s, got %v", dns.OpcodeToString[opcode], w.msgs)
+		}
+	}
+
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}}
+	m := new(dns.Msg)
+	m.SetQuestion("aoba.eagle-jump.", dns.TypeA)
+	m.Question = append(m.Question, m.Question[0])
+	s.ServeDNS(w, m)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeFormatError {
+		t.Errorf("Expected FORMERR for 2 questions, got %v", w.msgs)
+	}
+
+	w = &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}}
+	m = new(dns.Msg)
+	m.SetQuestion("aoba.eagle-jump.", dns.TypeA)
+	s.ServeDNS(w, m)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED for unauthorized client, got %v", w.msgs)
+	}
+}
+
+func TestAuthoritativeZone(t *testing.T) {
+	s := newTestServer(t)
+	// Upstreams must not be asked.
+	s.book().DNS.Upstreams = []string{"192.0.2.1:53"}
+
+	r := query(t, s, "aoba.eagle-jump.", dns.TypeA)
+	if !r.Authoritative || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Errorf("Unexpected reply: %v", r)
+	}
+
+	r = query(t, s, "nosuch.eagle-jump.", dns.TypeA)
+	if !r.Authoritative || r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+		t.Fatalf("Expected NXDOMAIN with SOA, got: %v", r)
+	}
+	if soa, ok := r.Ns[0].(*dns.SOA); !ok || soa.Hdr.Name != "eagle-jump." || soa.Hdr.Ttl != 60 || soa.Minttl != 60 {
+		t.Errorf("Unexpected SOA: %v", r.Ns[0])
+	}
+
+	r = query(t, s, "aoba.eagle-jump.", dns.TypeMX)
+	if !r.Authoritative || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || len(r.Ns) != 1 {
+		t.Errorf("Expected NODATA with SOA, got: %v", r)
+	}
+
+	r = query(t, s, "eagle-jump.", dns.TypeSOA)
+	if !r.Authoritative || len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("Unexpected reply: %v", r)
+	}
+	// The TTL of negative answers does not apply to SOA itself.
+	if soa := r.Answer[0].(*dns.SOA); soa.Hdr.Ttl != 600 || soa.Minttl != 60 {
+		t.Errorf("Unexpected SOA: %v", soa)
+	}
+
+	r = query(t, s, "eagle-jump.", dns.TypeNS)
+	if !r.Authoritative || len(r.Answer) != 1 || len(r.Extra) != 1 {
+		t.Fatalf("Expected NS with glue, got: %v", r)
+	}
+	if ns, ok := r.Answer[0].(*dns.NS); !ok || ns.Ns != "aoba.eagle-jump." {
+		t.Errorf("Unexpected NS: %v", r.Answer[0])
+	}
+}
+
+func TestUDPSize(t *testing.T) {
+	r := new(dns.Msg).SetQuestion("aoba.eagle-jump.", dns.TypeA)
+	if size := udpSize(r); size != dns.MinMsgSize {
+		t.Errorf("Expected %d without EDNS0, got %d", dns.MinMsgSize, size)
+	}
+	r.SetEdns0(4096, false)
+	if size := udpSize(r); size != 4096 {
+		t.Errorf("Expected advertised size 4096, got %d", size)
+	}
+	r = new(dns.Msg).SetQuestion("aoba.eagle-jump.", dns.TypeA)
+	r.SetEdns0(128, false)
+	if size := udpSize(r); size != dns.MinMsgSize {
+		t.Errorf("Sizes smaller than %d must be ignored, got %d", dns.MinMsgSize, size)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	c, err := conf.Load(util_test.ReadAll(t, "./config-sample.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text []string
+	for i := 0; i < 8; i++ {
+		text = append(text, string(bytes.Repeat([]byte{'a' + byte(i)}, 200)))
+	}
+	c.Records = append(c.Records, conf.Record{Name: "big.eagle-jump.", Type: "TXT", Text: text})
+	s := newTestServerFromConfig(t, c)
+
+	queryVia := func(remote net.Addr, udpSize uint16) *dns.Msg {
+		w := &testResponseWriter{remote: remote}
+		m := new(dns.Msg).SetQuestion("big.eagle-jump.", dns.TypeTXT)
+		if udpSize > 0 {
+			m.SetEdns0(udpSize, false)
+		}
+		s.ServeDNS(w, m)
+		if len(w.msgs) != 1 {
+			t.Fatalf("Expected exactly one reply, got %d", len(w.msgs))
+		}
+		return w.msgs[0]
+	}
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+	for _, size := range []uint16{0, 1232} {
+		r := queryVia(udp, size)
+		if !r.Truncated {
+			t.Errorf("Expected TC bit for UDP buffer size %d, got %v", size, r)
+		}
+		limit := int(size)
+		if limit < dns.MinMsgSize {
+			limit = dns.MinMsgSize
+		}
+		if r.Len() > limit {
+			t.Errorf("Reply of %d bytes does not fit in UDP buffer size %d", r.Len(), limit)
+		}
+	}
+	if r := queryVia(udp, 4096); r.Truncated || len(r.Answer) != 1 {
+		t.Errorf("Expected the full answer within the advertised size, got %v", r)
+	}
+	r := queryVia(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}, 0)
+	if r.Truncated || len(r.Answer) != 1 || len(r.Answer[0].(*dns.TXT).Txt) != len(text) {
+		t.Errorf("Expected the full answer over TCP, got %v", r)
+	}
+}
+
+func TestTCPListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := newTestServer(t)
+	s.book().DNS.Listen = addr
+	s = FromBook(s.book())
+	s.Start()
+	defer s.Stop()
+
+	c := &dns.Client{Net: "tcp"}
+	m := new(dns.Msg).SetQuestion("aoba.eagle-jump.", dns.TypeA)
+	var r *dns.Msg
+	for i := 0; i < 50; i++ {
+		r, _, err = c.Exchange(m, addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Errorf("Unexpected answer over TCP: %v", r)
+	}
+}
+
+func withClientSubnet(m *dns.Msg, ip net.IP) *dns.Msg {
+	m.SetEdns0(1232, true)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 32,
+		Address:       ip,
+	})
+	return m
+}
+
+func TestEDNS0(t *testing.T) {
+	s := newTestServer(t)
+
+	r := query(t, s, "aoba.eagle-jump.", dns.TypeA)
+	if r.IsEdns0() != nil {
+		t.Errorf("OPT must not be sent to clients without EDNS0: %v", r)
+	}
+
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}}
+	m := new(dns.Msg).SetQuestion("aoba.eagle-jump.", dns.TypeA)
+	m.SetEdns0(1232, true)
+	s.ServeDNS(w, m)
+	opt := w.msgs[0].IsEdns0()
+	if opt == nil || opt.UDPSize() != ednsUDPSize || !opt.Do() {
+		t.Errorf("Expected OPT with DO bit, got %v", w.msgs[0])
+	}
+
+	w = &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}}
+	m = new(dns.Msg).SetQuestion("aoba.eagle-jump.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	m.IsEdns0().SetVersion(1)
+	s.ServeDNS(w, m)
+	if w.msgs[0].Rcode != dns.RcodeBadVers {
+		t.Errorf("Expected BADVERS, got %s", dns.RcodeToString[w.msgs[0].Rcode])
+	}
+}
+
+func TestClientSubnetACL(t *testing.T) {
+	s := newTestServer(t)
+	proxy := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}
+
+	// Client subnets from untrusted sources are ignored.
+	w := &testResponseWriter{remote: proxy}
+	s.ServeDNS(w, withClientSubnet(new(dns.Msg).SetQuestion("aoba.eagle-jump.", dns.TypeA), net.IPv4(127, 0, 0, 5)))
+	if w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED, got %s", dns.RcodeToString[w.msgs[0].Rcode])
+	}
+
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	s.book().DNS.ClientSubnetProxies = []*net.IPNet{network}
+	w = &testResponseWriter{remote: proxy}
+	s.ServeDNS(w, withClientSubnet(new(dns.Msg).SetQuestion("aoba.eagle-jump.", dns.TypeA), net.IPv4(127, 0, 0, 5)))
+	r := w.msgs[0]
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("Expected an answer on behalf of the client, got %v", r)
+	}
+	ecs := clientSubnet(r)
+	if ecs == nil || !ecs.Address.Equal(net.IPv4(127, 0, 0, 5)) || ecs.SourceScope != 0 {
+		t.Errorf("Expected Client Subnet to be echoed, got %v", r.IsEdns0())
+	}
+
+	w = &testResponseWriter{remote: proxy}
+	s.ServeDNS(w, withClientSubnet(new(dns.Msg).SetQuestion("aoba.eagle-jump.", dns.TypeA), net.IPv4(198, 51, 100, 1)))
+	if w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED for the client out of networks, got %s", dns.RcodeToString[w.msgs[0].Rcode])
+	}
+}
+
+func TestRecords(t *testing.T) {
+	s := newTestServer(t)
+	s.book().DNS.Upstreams = nil
+
+	r := query(t, s, "db.eagle-jump.", dns.TypeA)
+	if len(r.Answer) != 2 {
+		t.Fatalf("Expected CNAME and A, got %v", r)
+	}
+	if cname, ok := r.Answer[0].(*dns.CNAME); !ok || cname.Target != "aoba.eagle-jump." {
+		t.Errorf("Unexpected CNAME: %v", r.Answer[0])
+	}
+	if a, ok := r.Answer[1].(*dns.A); !ok || a.Hdr.Name != "aoba.eagle-jump." || a.A.String() != "127.0.0.2" {
+		t.Errorf("Unexpected A: %v", r.Answer[1])
+	}
+
+	r = query(t, s, "db.eagle-jump.", dns.TypeCNAME)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("Expected only CNAME, got %v", r)
+	}
+
+	r = query(t, s, "eagle-jump.", dns.TypeMX)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.MX).Mx != "yagami.eagle-jump." {
+		t.Errorf("Unexpected MX: %v", r)
+	}
+
+	r = query(t, s, "eagle-jump.", dns.TypeTXT)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.TXT).Txt[0] != "v=spf1 mx -all" || r.Answer[0].Header().Ttl != 3600 {
+		t.Errorf("Unexpected TXT: %v", r)
+	}
+
+	r = query(t, s, "_ldap._tcp.eagle-jump.", dns.TypeSRV)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.SRV).Port != 389 {
+		t.Errorf("Unexpected SRV: %v", r)
+	}
+
+	r = query(t, s, "_tcp.eagle-jump.", dns.TypeSRV)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("Expected NODATA for empty non-terminal, got %v", r)
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	s := newTestServer(t)
+
+	r := query(t, s, "www.eagle-jump.", dns.TypeA)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.4" {
+		t.Errorf("Unexpected answer: %v", r)
+	}
+	r = query(t, s, "web.k8s.eagle-jump.", dns.TypeA)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Name != "web.k8s.eagle-jump." || r.Answer[0].(*dns.A).A.String() != "127.0.0.4" {
+		t.Errorf("Expected an answer synthesized from the wildcard, got %v", r)
+	}
+	r = query(t, s, "web.k8s.eagle-jump.", dns.TypeMX)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("Expected NODATA, got %v", r)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	s := newTestServer(t)
+
+	first := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r := query(t, s, "api.eagle-jump.", dns.TypeA)
+		if len(r.Answer) != 2 {
+			t.Fatalf("Expected all addresses of the shared name, got %v", r)
+		}
+		first[r.Answer[0].(*dns.A).A.String()] = true
+	}
+	if !first["127.0.0.3"] || !first["127.0.0.4"] {
+		t.Errorf("Expected answers in rotated order, got %v first", first)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	s := newTestServer(t)
+	s.book().DNS.Upstreams = nil
+
+	r := query(t, s, "AoBa.EAGLE-jump.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.Answer[0].Header().Name != "AoBa.EAGLE-jump." {
+		t.Errorf("Expected an answer with the name as questioned, got %v", r)
+	}
+	r = query(t, s, "DB.eagle-jump.", dns.TypeA)
+	if len(r.Answer) != 2 || r.Answer[0].Header().Name != "DB.eagle-jump." || r.Answer[1].Header().Name != "aoba.eagle-jump." {
+		t.Errorf("Unexpected answer: %v", r)
+	}
+	r = query(t, s, "Eagle-Jump.", dns.TypeSOA)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Name != "Eagle-Jump." {
+		t.Errorf("Unexpected answer: %v", r)
+	}
+	r = query(t, s, "Eagle-Jump.", dns.TypeTXT)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Name != "Eagle-Jump." {
+		t.Errorf("Unexpected answer: %v", r)
+	}
+	if r := query(t, s, "eagle-jump.", dns.TypeTXT); r.Answer[0].Header().Name != "eagle-jump." {
+		t.Errorf("Records in the book must not be modified: %v", r)
+	}
+}
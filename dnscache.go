@@ -0,0 +1,223 @@
+package disq
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledyba/disq/book"
+	"github.com/miekg/dns"
+)
+
+type DNSCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	edns   bool
+	do     bool
+	cd     bool
+}
+
+type dnsCacheEntry struct {
+	key     dnsCacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// LRU cache for answers from upstreams.
+type dnsCache struct {
+	// Accessed atomically. Keep them 64-bit aligned.
+	hits   uint64
+	misses uint64
+
+	config book.DNSCache
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	lru     *list.List
+}
+
+// newDNSCache returns nil if the cache is disabled.
+func newDNSCache(config book.DNSCache) *dnsCache {
+	if config.MaxEntries <= 0 {
+		return nil
+	}
+	return &dnsCache{
+		config:  config,
+		now:     time.Now,
+		entries: make(map[dnsCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func makeDNSCacheKey(r *dns.Msg) dnsCacheKey {
+	q := r.Question[0]
+	key := dnsCacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		cd:     r.CheckingDisabled,
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		key.edns = true
+		key.do = opt.Do()
+	}
+	return key
+}
+
+// get returns a copy of the cached answer for the request with TTLs
+// decremented by the time spent in the cache, or nil.
+func (c *dnsCache) get(r *dns.Msg) *dns.Msg {
+	key := makeDNSCacheKey(r)
+	now := c.now()
+	c.mutex.Lock()
+	elem, ok := c.entries[key]
+	if ok && !now.Before(elem.Value.(*dnsCacheEntry).expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.mutex.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*dnsCacheEntry)
+	c.mutex.Unlock()
+	atomic.AddUint64(&c.hits, 1)
+
+	m := entry.msg.Copy()
+	m.Id = r.Id
+	m.Question = append([]dns.Question(nil), r.Question...)
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl -= elapsed
+		}
+	}
+	return m
+}
+
+// put stores the answer for the request if it is cacheable.
+// Negative answers are cached as RFC 2308 describes.
+func (c *dnsCache) put(r, resp *dns.Msg) {
+	if resp.Truncated {
+		return
+	}
+	ttl := minTTL(resp)
+	var soa *dns.SOA
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		// Positive answer. The smallest TTL in it wins.
+	case resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError:
+		// NXDOMAIN or NODATA. Without SOA, we must not cache it.
+		soa = findSOA(resp.Ns)
+		if soa == nil {
+			return
+		}
+		if soa.Hdr.Ttl < ttl {
+			ttl = soa.Hdr.Ttl
+		}
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	default:
+		return
+	}
+	ttl = c.clamp(ttl)
+	if ttl == 0 {
+		return
+	}
+
+	m := resp.Copy()
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			hdr.Ttl = c.clamp(hdr.Ttl)
+			if hdr.Ttl < ttl || (soa != nil && hdr.Rrtype == dns.TypeSOA) {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+	now := c.now()
+	entry := &dnsCacheEntry{
+		key:     makeDNSCacheKey(r),
+		msg:     m,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+func (c *dnsCache) clamp(ttl uint32) uint32 {
+	if ttl < uint32(c.config.MinTTL) {
+		ttl = uint32(c.config.MinTTL)
+	}
+	if c.config.MaxTTL > 0 && ttl > uint32(c.config.MaxTTL) {
+		ttl = uint32(c.config.MaxTTL)
+	}
+	return ttl
+}
+
+func (c *dnsCache) stats() DNSCacheStats {
+	c.mutex.Lock()
+	entries := c.lru.Len()
+	c.mutex.Unlock()
+	return DNSCacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: entries,
+	}
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	ttl := ^uint32(0)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype != dns.TypeOPT && hdr.Ttl < ttl {
+				ttl = hdr.Ttl
+			}
+		}
+	}
+	return ttl
+}
+
+func findSOA(rrs []dns.RR) *dns.SOA {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package disq
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ledyba/disq/book"
+	"github.com/miekg/dns"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time { return c.t }
+
+func newTestCache(config book.DNSCache) (*dnsCache, *testClock) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	c := newDNSCache(config)
+	c.now = clock.now
+	return c, clock
+}
+
+func answerA(r *dns.Msg, ttl uint32) *dns.Msg {
+	m := newReply(r)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	return m
+}
+
+func answerNXDomain(r *dns.Msg, soaTTL, minTTL uint32) *dns.Msg {
+	m := newReply(r)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: minTTL,
+	})
+	return m
+}
+
+func TestDNSCacheDisabled(t *testing.T) {
+	if c := newDNSCache(book.DNSCache{}); c != nil {
+		t.Errorf("Cache must be disabled when max-entries is 0")
+	}
+}
+
+func TestDNSCachePositive(t *testing.T) {
+	c, clock := newTestCache(book.DNSCache{MaxEntries: 10})
+	r := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+
+	if m := c.get(r); m != nil {
+		t.Fatalf("Empty cache returned %v", m)
+	}
+	c.put(r, answerA(r, 60))
+
+	clock.t = clock.t.Add(20 * time.Second)
+	r2 := new(dns.Msg).SetQuestion("WWW.example.", dns.TypeA)
+	m := c.get(r2)
+	if m == nil {
+		t.Fatal("Expected a cache hit")
+	}
+	if m.Id != r2.Id || m.Question[0].Name != "WWW.example." {
+		t.Errorf("Cached answer is not for the request: %v", m)
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != 40 {
+		t.Errorf("Expected TTL 40, got %d", ttl)
+	}
+
+	clock.t = clock.t.Add(40 * time.Second)
+	if m := c.get(r); m != nil {
+		t.Errorf("Expired answer returned: %v", m)
+	}
+	stats := c.stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	c, clock := newTestCache(book.DNSCache{MaxEntries: 10})
+	r := new(dns.Msg).SetQuestion("nosuch.example.", dns.TypeA)
+
+	// No SOA, no caching.
+	m := newReply(r)
+	m.Rcode = dns.RcodeNameError
+	c.put(r, m)
+	if m := c.get(r); m != nil {
+		t.Fatalf("NXDOMAIN without SOA must not be cached: %v", m)
+	}
+
+	// Negative TTL is min(SOA TTL, SOA MINIMUM).
+	c.put(r, answerNXDomain(r, 3600, 30))
+	clock.t = clock.t.Add(10 * time.Second)
+	m = c.get(r)
+	if m == nil || m.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected cached NXDOMAIN, got %v", m)
+	}
+	if ttl := m.Ns[0].Header().Ttl; ttl != 20 {
+		t.Errorf("Expected SOA TTL 20, got %d", ttl)
+	}
+	clock.t = clock.t.Add(20 * time.Second)
+	if m := c.get(r); m != nil {
+		t.Errorf("Expired NXDOMAIN returned: %v", m)
+	}
+
+	// SERVFAIL is never cached.
+	m = newReply(r)
+	m.Rcode = dns.RcodeServerFailure
+	c.put(r, m)
+	if m := c.get(r); m != nil {
+		t.Errorf("SERVFAIL must not be cached: %v", m)
+	}
+}
+
+func TestDNSCacheClamp(t *testing.T) {
+	c, _ := newTestCache(book.DNSCache{MaxEntries: 10, MinTTL: 30, MaxTTL: 300})
+	short := new(dns.Msg).SetQuestion("short.example.", dns.TypeA)
+	long := new(dns.Msg).SetQuestion("long.example.", dns.TypeA)
+	c.put(short, answerA(short, 0))
+	c.put(long, answerA(long, 86400))
+	if m := c.get(short); m == nil || m.Answer[0].Header().Ttl != 30 {
+		t.Errorf("Expected TTL to be raised to 30, got %v", m)
+	}
+	if m := c.get(long); m == nil || m.Answer[0].Header().Ttl != 300 {
+		t.Errorf("Expected TTL to be lowered to 300, got %v", m)
+	}
+}
+
+func TestDNSCacheEviction(t *testing.T) {
+	c, _ := newTestCache(book.DNSCache{MaxEntries: 2})
+	a := new(dns.Msg).SetQuestion("a.example.", dns.TypeA)
+	b := new(dns.Msg).SetQuestion("b.example.", dns.TypeA)
+	d := new(dns.Msg).SetQuestion("d.example.", dns.TypeA)
+	c.put(a, answerA(a, 60))
+	c.put(b, answerA(b, 60))
+	c.get(a) // a is now more recently used than b.
+	c.put(d, answerA(d, 60))
+	if c.get(b) != nil {
+		t.Errorf("Least recently used entry must be evicted")
+	}
+	if c.get(a) == nil || c.get(d) == nil {
+		t.Errorf("Recently used entries must be kept")
+	}
+}
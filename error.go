@@ -14,6 +14,15 @@ func (e *DHCP4Error) Error() string {
 	return fmt.Sprintf("DHCP4Error: network=%s err=%s", e.Network, e.Err)
 }
 
+type DHCP6Error struct {
+	Err     error
+	Network string
+}
+
+func (e *DHCP6Error) Error() string {
+	return fmt.Sprintf("DHCP6Error: network=%s err=%s", e.Network, e.Err)
+}
+
 type DHCP4WrongAddressRequestedError struct {
 	SName        string
 	HardwareAddr net.HardwareAddr
@@ -25,6 +34,31 @@ func (e *DHCP4WrongAddressRequestedError) Error() string {
 	return fmt.Sprintf("request packet received from %s(%s) for %s, but we expect that the address is %s", e.SName, e.HardwareAddr.String(), e.Requested.String(), e.Expected.String())
 }
 
+// DHCP4AddressConflictError is reported when something answers at
+// the address before we offer it.
+type DHCP4AddressConflictError struct {
+	Network      string
+	HardwareAddr net.HardwareAddr
+	Addr         net.IP
+}
+
+func (e *DHCP4AddressConflictError) Error() string {
+	return fmt.Sprintf("address %s to be offered to %s in network %s is already in use", e.Addr.String(), e.HardwareAddr.String(), e.Network)
+}
+
+// DHCP4DeclineError is reported when a client found the address we gave
+// in use by another host.
+type DHCP4DeclineError struct {
+	Network      string
+	HardwareAddr net.HardwareAddr
+	Addr         net.IP
+	Message      string // sent by the client. Empty if not.
+}
+
+func (e *DHCP4DeclineError) Error() string {
+	return fmt.Sprintf("address %s in network %s is declined by %s, since it is used by another host: %q", e.Addr.String(), e.Network, e.HardwareAddr.String(), e.Message)
+}
+
 type DNSError struct {
 	Err error
 }
@@ -32,3 +66,20 @@ type DNSError struct {
 func (e *DNSError) Error() string {
 	return fmt.Sprintf("DNS Error: err=%s", e.Err)
 }
+
+type TFTPError struct {
+	Err     error
+	Network string
+}
+
+func (e *TFTPError) Error() string {
+	return fmt.Sprintf("TFTPError: network=%s err=%s", e.Network, e.Err)
+}
+
+type LeaseJournalError struct {
+	Err error
+}
+
+func (e *LeaseJournalError) Error() string {
+	return fmt.Sprintf("LeaseJournalError: err=%s", e.Err)
+}
@@ -0,0 +1,74 @@
+package disq
+
+import (
+	"errors"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrNoUpstreams = errors.New("no upstream DNS servers are configured")
+)
+
+// resolve answers the request from the cache, or forwards it upstream.
+func (s *Server) resolve(r *dns.Msg) (*dns.Msg, error) {
+	c := s.cache()
+	if c != nil {
+		if m := c.get(r); m != nil {
+			return m, nil
+		}
+	}
+	m, err := s.forward(r)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.put(r, m)
+	}
+	return m, nil
+}
+
+// forward sends the request to the upstreams in the configured order and
+// returns the first reply, as it is. When an upstream does not reply in
+// time, the next one is tried.
+func (s *Server) forward(r *dns.Msg) (*dns.Msg, error) {
+	b := s.book()
+	if len(b.DNS.Upstreams) == 0 {
+		return nil, ErrNoUpstreams
+	}
+	// EDNS0 is passed through, except Client Subnet: answers are cached
+	// and shared among clients.
+	req := r.Copy()
+	req.Id = dns.Id()
+	if opt := req.IsEdns0(); opt != nil {
+		options := make([]dns.EDNS0, 0, len(opt.Option))
+		for _, o := range opt.Option {
+			if o.Option() != dns.EDNS0SUBNET {
+				options = append(options, o)
+			}
+		}
+		opt.Option = options
+	}
+	var err error
+	for _, upstream := range b.DNS.Upstreams {
+		c := &dns.Client{
+			Net:     "udp",
+			Timeout: b.DNS.UpstreamTimeout,
+		}
+		var resp *dns.Msg
+		resp, _, err = c.Exchange(req, upstream)
+		if err == nil && resp.Truncated {
+			// Retry over TCP to get the full answer.
+			c.Net = "tcp"
+			resp, _, err = c.Exchange(req, upstream)
+		}
+		if err != nil {
+			log.WithField("Module", "DNS").WithError(err).Warnf("Upstream %s did not answer", upstream)
+			continue
+		}
+		resp.Id = r.Id
+		return resp, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,113 @@
+package disq
+
+import (
+	"net"
+	"testing"
+
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startUpstream runs a DNS server on a random local port.
+func startUpstream(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+// startBlackhole opens a port which never replies.
+func startBlackhole(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc.LocalAddr().String(), func() { pc.Close() }
+}
+
+func TestForwardFailover(t *testing.T) {
+	dead, closeDead := startBlackhole(t)
+	defer closeDead()
+	alive, closeAlive := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr:     dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900},
+			Ns:      "a.gtld-servers.net.",
+			Mbox:    "nstld.verisign-grs.com.",
+			Serial:  1,
+			Refresh: 1800,
+			Retry:   900,
+			Expire:  604800,
+			Minttl:  86400,
+		})
+		w.WriteMsg(m)
+	})
+	defer closeAlive()
+
+	s := newTestServer(t)
+	s.book().DNS.Upstreams = []string{dead, alive}
+	s.book().DNS.UpstreamTimeout = 100 * time.Millisecond
+
+	r := query(t, s, "nosuch.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN to be relayed, got %s", dns.RcodeToString[r.Rcode])
+	}
+	if len(r.Ns) != 1 || r.Ns[0].Header().Ttl != 900 {
+		t.Errorf("Expected SOA to be relayed as is, got %v", r.Ns)
+	}
+}
+
+func TestForwardAllUpstreamsDown(t *testing.T) {
+	dead, closeDead := startBlackhole(t)
+	defer closeDead()
+
+	s := newTestServer(t)
+	s.book().DNS.Upstreams = []string{dead}
+	s.book().DNS.UpstreamTimeout = 100 * time.Millisecond
+
+	r := query(t, s, "google.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL, got %s", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestForwardEDNS0(t *testing.T) {
+	received := make(chan *dns.Msg, 1)
+	upstream, closeUpstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		received <- r
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		m.SetEdns0(512, false)
+		w.WriteMsg(m)
+	})
+	defer closeUpstream()
+
+	s := newTestServer(t)
+	s.book().DNS.Upstreams = []string{upstream}
+	s.book().DNS.UpstreamTimeout = time.Second
+
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}}
+	s.ServeDNS(w, withClientSubnet(new(dns.Msg).SetQuestion("google.com.", dns.TypeA), net.IPv4(127, 0, 0, 1)))
+	req := <-received
+	opt := req.IsEdns0()
+	if opt == nil || opt.UDPSize() != 1232 || !opt.Do() {
+		t.Errorf("EDNS0 must be passed to upstreams, got %v", req)
+	}
+	if clientSubnet(req) != nil {
+		t.Errorf("Client Subnet must not be passed to upstreams, got %v", opt)
+	}
+	if len(w.msgs) != 1 || w.msgs[0].IsEdns0() == nil || w.msgs[0].IsEdns0().UDPSize() != ednsUDPSize {
+		t.Errorf("Expected our OPT in the reply, got %v", w.msgs)
+	}
+}
@@ -0,0 +1,125 @@
+package disq
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lease is what disq knows about a DHCP4 client in a network.
+// Timestamps are zero if the event has never happened.
+type Lease struct {
+	Network      string
+	HardwareAddr net.HardwareAddr
+	IP           net.IP
+	ClientID     []byte // Client Identifier option, sent by the client.
+	HostName     string // Host Name option, sent by the client.
+	Offered      time.Time
+	Acked        time.Time
+	Released     time.Time
+	Declined     time.Time
+	Expires      time.Time
+}
+
+// Active reports whether the client holds the lease at the time.
+func (l *Lease) Active(now time.Time) bool {
+	return !l.Acked.IsZero() && now.Before(l.Expires)
+}
+
+type leaseKey struct {
+	network string
+	hwaddr  string
+}
+
+// In-memory lease table, keyed by network and hardware address.
+type leaseTable struct {
+	now func() time.Time
+
+	mutex   sync.Mutex
+	leases  map[leaseKey]*Lease
+	journal *leaseJournal // nil if leases are not persisted.
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{
+		now:    time.Now,
+		leases: make(map[leaseKey]*Lease),
+	}
+}
+
+// update applies f to the lease of the client, creating it if needed,
+// and returns a copy of the result. The error is from the journal;
+// the table is updated anyway.
+func (t *leaseTable) update(network string, hwaddr net.HardwareAddr, f func(l *Lease, now time.Time)) (Lease, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := leaseKey{network, string(hwaddr)}
+	l, ok := t.leases[key]
+	if !ok {
+		l = &Lease{
+			Network:      network,
+			HardwareAddr: append(net.HardwareAddr(nil), hwaddr...),
+		}
+		t.leases[key] = l
+	}
+	f(l, t.now())
+	return *l, t.record(l)
+}
+
+func (t *leaseTable) get(network string, hwaddr net.HardwareAddr) (Lease, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	l, ok := t.leases[leaseKey{network, string(hwaddr)}]
+	if !ok {
+		return Lease{}, false
+	}
+	return *l, true
+}
+
+// all returns copies of the leases, sorted by network and hardware address.
+func (t *leaseTable) all() []Lease {
+	t.mutex.Lock()
+	leases := make([]Lease, 0, len(t.leases))
+	for _, l := range t.leases {
+		leases = append(leases, *l)
+	}
+	t.mutex.Unlock()
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].Network != leases[j].Network {
+			return leases[i].Network < leases[j].Network
+		}
+		return bytes.Compare(leases[i].HardwareAddr, leases[j].HardwareAddr) < 0
+	})
+	return leases
+}
+
+// Lease returns what we know about the client in the network.
+func (s *Server) Lease(network string, hwaddr net.HardwareAddr) (Lease, bool) {
+	return s.leases.get(network, hwaddr)
+}
+
+// Leases returns all the leases, sorted by network and hardware address.
+func (s *Server) Leases() []Lease {
+	return s.leases.all()
+}
+
+// MachineLeases returns the leases of the interfaces of the machine,
+// so that we can tell whether it is up.
+func (s *Server) MachineLeases(name string) []Lease {
+	m, ok := s.book().Machines[name]
+	if !ok {
+		return nil
+	}
+	var leases []Lease
+	for _, l := range s.leases.all() {
+		for _, nic := range m.Interfaces {
+			if bytes.Equal(l.HardwareAddr, nic.HardwareAddr) {
+				leases = append(leases, l)
+				break
+			}
+		}
+	}
+	return leases
+}
@@ -0,0 +1,69 @@
+package disq
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func request(ds *dhcp4Server, msgType dhcp.MessageType, hwaddr string, ciaddr net.IP, options ...dhcp.Option) dhcp.Packet {
+	mac, _ := net.ParseMAC(hwaddr)
+	p := dhcp.RequestPacket(msgType, mac, ciaddr, []byte{1, 2, 3, 4}, false, options)
+	return ds.ServeDHCP(p, msgType, p.ParseOptions())
+}
+
+func TestLeases(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	s := ds.parent
+	now := time.Date(2017, 4, 1, 9, 0, 0, 0, time.UTC)
+	s.leases.now = func() time.Time { return now }
+	hwaddr, _ := net.ParseMAC("72:00:07:ef:42:80")
+	identity := []dhcp.Option{
+		{Code: dhcp.OptionHostName, Value: []byte("aoba-laptop")},
+		{Code: dhcp.OptionClientIdentifier, Value: []byte{1, 0x72, 0, 7, 0xef, 0x42, 0x80}},
+	}
+
+	if _, ok := s.Lease("loopback", hwaddr); ok {
+		t.Fatal("Lease exists before any message")
+	}
+	res := request(ds, dhcp.Discover, hwaddr.String(), nil, identity...)
+	l, ok := s.Lease("loopback", hwaddr)
+	if !ok || !l.Offered.Equal(now) || !l.IP.Equal(res.YIAddr()) || l.Active(now) {
+		t.Fatalf("Unexpected lease after offer: %+v", l)
+	}
+	if l.HostName != "aoba-laptop" || len(l.ClientID) != 7 {
+		t.Errorf("Client identity is not recorded: %+v", l)
+	}
+
+	now = now.Add(time.Second)
+	request(ds, dhcp.Request, hwaddr.String(), nil, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: res.YIAddr()})
+	l, _ = s.Lease("loopback", hwaddr)
+	if !l.Acked.Equal(now) || !l.Expires.Equal(now.Add(24*time.Hour)) || !l.Active(now) {
+		t.Fatalf("Unexpected lease after ACK: %+v", l)
+	}
+	if l.HostName != "aoba-laptop" {
+		t.Errorf("Host name is lost: %+v", l)
+	}
+	leases := s.MachineLeases("aoba")
+	if len(leases) != 1 || !leases[0].Active(now) {
+		t.Errorf("aoba must be holding its lease: %+v", leases)
+	}
+	if leases := s.MachineLeases("yagami"); len(leases) != 0 {
+		t.Errorf("Unexpected leases of yagami: %+v", leases)
+	}
+
+	now = now.Add(time.Hour)
+	request(ds, dhcp.Release, hwaddr.String(), res.YIAddr())
+	l, _ = s.Lease("loopback", hwaddr)
+	if !l.Released.Equal(now) || l.Active(now) || !l.IP.Equal(res.YIAddr()) {
+		t.Errorf("Unexpected lease after release: %+v", l)
+	}
+
+	other, _ := net.ParseMAC("72:00:07:ef:42:81")
+	request(ds, dhcp.Discover, other.String(), nil)
+	if leases := s.Leases(); len(leases) != 2 || leases[0].HardwareAddr.String() != hwaddr.String() {
+		t.Errorf("Unexpected leases: %+v", leases)
+	}
+}
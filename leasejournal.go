@@ -0,0 +1,343 @@
+package disq
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const leaseJournalName = "leases.journal"
+
+// The journal is rewritten when it has this many more lines than leases.
+const leaseJournalSlack = 1024
+
+// Appended lines are flushed to the disk this often, not on every update,
+// so that DHCP is not stalled by a slow disk. Updates in the last interval
+// may be lost on a power failure, but not on a crash of disq.
+const leaseJournalSyncInterval = time.Second
+
+// leaseRecord is a line of the journal.
+type leaseRecord struct {
+	Network      string    `json:"network"`
+	HardwareAddr string    `json:"hwaddr"`
+	IP           net.IP    `json:"ip,omitempty"`
+	ClientID     string    `json:"client-id,omitempty"` /* in hex */
+	HostName     string    `json:"host-name,omitempty"`
+	Offered      time.Time `json:"offered"`
+	Acked        time.Time `json:"acked"`
+	Released     time.Time `json:"released"`
+	Declined     time.Time `json:"declined"`
+	Expires      time.Time `json:"expires"`
+}
+
+func recordOfLease(l *Lease) *leaseRecord {
+	return &leaseRecord{
+		Network:      l.Network,
+		HardwareAddr: l.HardwareAddr.String(),
+		IP:           l.IP,
+		ClientID:     hex.EncodeToString(l.ClientID),
+		HostName:     l.HostName,
+		Offered:      l.Offered,
+		Acked:        l.Acked,
+		Released:     l.Released,
+		Declined:     l.Declined,
+		Expires:      l.Expires,
+	}
+}
+
+func (r *leaseRecord) lease() (*Lease, error) {
+	hwaddr, err := net.ParseMAC(r.HardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+	clientID, err := hex.DecodeString(r.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if len(clientID) == 0 {
+		clientID = nil
+	}
+	return &Lease{
+		Network:      r.Network,
+		HardwareAddr: hwaddr,
+		IP:           r.IP,
+		ClientID:     clientID,
+		HostName:     r.HostName,
+		Offered:      r.Offered,
+		Acked:        r.Acked,
+		Released:     r.Released,
+		Declined:     r.Declined,
+		Expires:      r.Expires,
+	}, nil
+}
+
+// Each line is "<crc32 of json in hex> <json>\n", so that torn writes
+// after a crash can be detected.
+func marshalLeaseLine(l *Lease) ([]byte, error) {
+	dat, err := json.Marshal(recordOfLease(l))
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(dat)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(dat))...)
+	line = append(line, dat...)
+	return append(line, '\n'), nil
+}
+
+func parseLeaseLine(line []byte) (*Lease, error) {
+	if len(line) < 10 || line[8] != ' ' || line[len(line)-1] != '\n' {
+		return nil, fmt.Errorf("malformed line")
+	}
+	var sum uint32
+	if _, err := fmt.Sscanf(string(line[:8]), "%08x", &sum); err != nil {
+		return nil, err
+	}
+	dat := line[9 : len(line)-1]
+	if crc32.ChecksumIEEE(dat) != sum {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	var r leaseRecord
+	if err := json.Unmarshal(dat, &r); err != nil {
+		return nil, err
+	}
+	return r.lease()
+}
+
+// leaseJournal is an append-only file of leases. The last line for
+// a client wins.
+type leaseJournal struct {
+	path  string
+	file  *os.File
+	lines int
+
+	// Held while syncing, and while replacing file. Appending does not
+	// need it, since it never waits for the disk.
+	syncing sync.Mutex
+	dirty   int32 // 1 if there are lines not synced yet.
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newLeaseJournal(path string) *leaseJournal {
+	return &leaseJournal{
+		path: path,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// readLeaseJournal reads leases until the end of the file or the first
+// broken line. Lines after a broken one are dropped.
+func readLeaseJournal(path string) ([]*Lease, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var leases []*Lease
+	r := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return leases, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		l, err := parseLeaseLine(line)
+		if err != nil {
+			log.
+				WithField("Module", "Lease").
+				WithError(err).
+				Warnf("Journal %s is broken at line %d. The rest is dropped.", path, lineNo)
+			return leases, nil
+		}
+		leases = append(leases, l)
+	}
+}
+
+// compact rewrites the journal with only the current leases.
+func (j *leaseJournal) compact(leases []*Lease) error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, l := range leases {
+		line, err := marshalLeaseLine(l)
+		if err == nil {
+			_, err = w.Write(line)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	j.syncing.Lock()
+	defer j.syncing.Unlock()
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	j.lines = len(leases)
+	atomic.StoreInt32(&j.dirty, 0)
+	return err
+}
+
+func (j *leaseJournal) append(l *Lease) error {
+	if j.file == nil {
+		return fmt.Errorf("journal %s is not open", j.path)
+	}
+	line, err := marshalLeaseLine(l)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(line); err != nil {
+		return err
+	}
+	j.lines++
+	atomic.StoreInt32(&j.dirty, 1)
+	return nil
+}
+
+// sync flushes the lines appended since the last sync to the disk.
+func (j *leaseJournal) sync() error {
+	j.syncing.Lock()
+	defer j.syncing.Unlock()
+	if j.file == nil || atomic.SwapInt32(&j.dirty, 0) == 0 {
+		return nil
+	}
+	return j.file.Sync()
+}
+
+func (j *leaseJournal) syncLoop() {
+	defer close(j.done)
+	ticker := time.NewTicker(leaseJournalSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.sync(); err != nil {
+				log.
+					WithField("Module", "Lease").
+					WithError(err).
+					Errorf("Failed to sync journal %s", j.path)
+			}
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+func (j *leaseJournal) close() error {
+	close(j.stop)
+	<-j.done
+	err := j.sync()
+	j.syncing.Lock()
+	defer j.syncing.Unlock()
+	if j.file == nil {
+		return err
+	}
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	j.file = nil
+	return err
+}
+
+// openJournal loads the leases from the journal in the directory, and
+// records updates there afterwards.
+func (t *leaseTable) openJournal(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, leaseJournalName)
+	leases, err := readLeaseJournal(path)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, l := range leases {
+		t.leases[leaseKey{l.Network, string(l.HardwareAddr)}] = l
+	}
+	j := newLeaseJournal(path)
+	// Broken tails and old lines are dropped here.
+	if err := j.compact(t.snapshot()); err != nil {
+		return err
+	}
+	go j.syncLoop()
+	if t.journal != nil {
+		t.journal.close()
+	}
+	t.journal = j
+	log.
+		WithField("Module", "Lease").
+		Infof("%d leases loaded from %s", len(t.leases), path)
+	return nil
+}
+
+func (t *leaseTable) closeJournal() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.journal == nil {
+		return nil
+	}
+	err := t.journal.close()
+	t.journal = nil
+	return err
+}
+
+// record writes the lease to the journal. Must be called with the mutex held.
+func (t *leaseTable) record(l *Lease) error {
+	if t.journal == nil {
+		return nil
+	}
+	if t.journal.lines > len(t.leases)+leaseJournalSlack {
+		return t.journal.compact(t.snapshot())
+	}
+	return t.journal.append(l)
+}
+
+// snapshot returns the leases. Must be called with the mutex held.
+func (t *leaseTable) snapshot() []*Lease {
+	leases := make([]*Lease, 0, len(t.leases))
+	for _, l := range t.leases {
+		leases = append(leases, l)
+	}
+	return leases
+}
+
+// OpenLeaseJournal loads the lease history kept in the directory, and
+// keeps it up to date afterwards. Call it before Start.
+func (s *Server) OpenLeaseJournal(dir string) error {
+	return s.leases.openJournal(dir)
+}
@@ -0,0 +1,122 @@
+package disq
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaseJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disq-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2017, 4, 1, 9, 0, 0, 0, time.UTC)
+	aoba, _ := net.ParseMAC("72:00:07:ef:42:80")
+	hifumi, _ := net.ParseMAC("72:00:07:ef:42:81")
+
+	table := newLeaseTable()
+	table.now = func() time.Time { return now }
+	if err := table.openJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	ack := func(l *Lease, now time.Time) {
+		l.IP = net.IPv4(127, 0, 0, 2).To4()
+		l.HostName = "aoba"
+		l.ClientID = []byte{1, 2, 3}
+		l.Acked = now
+		l.Expires = now.Add(time.Hour)
+	}
+	if _, err := table.update("loopback", aoba, ack); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.update("loopback", hifumi, func(l *Lease, now time.Time) { l.Offered = now }); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := table.update("loopback", hifumi, func(l *Lease, now time.Time) { l.Released = now }); err != nil {
+		t.Fatal(err)
+	}
+	table.closeJournal()
+
+	// Simulate a crash while writing.
+	path := filepath.Join(dir, leaseJournalName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("0badc0de {\"network\":\"loopback\",\"hwaddr\":\"72:00:07:ef:42:80\"}\n")
+	f.WriteString("01234567 {\"network\":\"loop")
+	f.Close()
+
+	loaded := newLeaseTable()
+	if err := loaded.openJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.closeJournal()
+	l, ok := loaded.get("loopback", aoba)
+	if !ok || !l.Active(now) || l.HostName != "aoba" || len(l.ClientID) != 3 || !l.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("Unexpected lease of aoba: %+v", l)
+	}
+	l, ok = loaded.get("loopback", hifumi)
+	if !ok || !l.Released.Equal(now) || l.Offered.IsZero() {
+		t.Errorf("Unexpected lease of hifumi: %+v", l)
+	}
+
+	// The journal is compacted, and the broken tail is dropped.
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(dat), "\n"); lines != 2 || !strings.HasSuffix(string(dat), "\n") {
+		t.Errorf("Journal must be compacted, got:\n%s", dat)
+	}
+
+	// And rewritten when it has grown.
+	for i := 0; i < leaseJournalSlack+10; i++ {
+		if _, err := loaded.update("loopback", aoba, ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loaded.journal.lines > leaseJournalSlack+2 {
+		t.Errorf("Journal is not compacted: %d lines", loaded.journal.lines)
+	}
+}
+
+func TestLeaseJournalSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disq-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aoba, _ := net.ParseMAC("72:00:07:ef:42:80")
+
+	table := newLeaseTable()
+	if err := table.openJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer table.closeJournal()
+	// Updates are written at once, but synced later.
+	if _, err := table.update("loopback", aoba, func(l *Lease, now time.Time) { l.Offered = now }); err != nil {
+		t.Fatal(err)
+	}
+	j := table.journal
+	if atomic.LoadInt32(&j.dirty) != 1 {
+		t.Error("Appended lines must be synced later")
+	}
+	if err := j.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&j.dirty) != 0 {
+		t.Error("Lines must be synced")
+	}
+	if leases, err := readLeaseJournal(filepath.Join(dir, leaseJournalName)); err != nil || len(leases) != 1 {
+		t.Errorf("Unexpected journal: %v, %v", leases, err)
+	}
+}
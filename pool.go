@@ -0,0 +1,127 @@
+package disq
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/ledyba/disq/book"
+)
+
+// An offered address is kept for the client for a while, even though
+// the client has not requested it yet.
+const dynamicOfferHold = time.Minute
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// holds reports whether the client keeps the address at the time,
+// by a lease or an offer not answered yet.
+func (l *Lease) holds(now time.Time) bool {
+	if l.IP == nil {
+		return false
+	}
+	if now.Before(l.Expires) {
+		return true
+	}
+	pending := l.Offered.After(l.Acked) && l.Offered.After(l.Released) && l.Offered.After(l.Declined)
+	return pending && now.Sub(l.Offered) < dynamicOfferHold
+}
+
+// leaseDynamic picks an address of the range for the client, and applies
+// f to its lease. If requested is not nil, only it can be picked. Otherwise
+// the address the client had is preferred, then addresses never leased,
+// then addresses whose leases have expired.
+// It returns nil if no address is available.
+func (t *leaseTable) leaseDynamic(network string, hwaddr net.HardwareAddr, r *book.AddressRange, requested net.IP, excluded func(ip net.IP) bool, f func(l *Lease, now time.Time)) (net.IP, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now()
+	key := leaseKey{network, string(hwaddr)}
+	// Addresses in the range known to the table, and whether they are held.
+	used := make(map[uint32]bool)
+	for k, l := range t.leases {
+		if k == key || k.network != network || !r.Contains(l.IP) {
+			continue
+		}
+		n := ipToUint32(l.IP)
+		used[n] = used[n] || l.holds(now)
+	}
+	free := func(ip net.IP) bool {
+		return r.Contains(ip) && !used[ipToUint32(ip)] && !excluded(ip)
+	}
+	var ip net.IP
+	if requested != nil {
+		if free(requested) {
+			ip = requested.To4()
+		}
+	} else if l, ok := t.leases[key]; ok && free(l.IP) {
+		ip = l.IP
+	} else {
+		ip = t.findFree(r, used, excluded)
+	}
+	if ip == nil {
+		return nil, nil
+	}
+	ip = append(net.IP(nil), ip...)
+	l, ok := t.leases[key]
+	if !ok {
+		l = &Lease{
+			Network:      network,
+			HardwareAddr: append(net.HardwareAddr(nil), hwaddr...),
+		}
+		t.leases[key] = l
+	}
+	l.IP = ip
+	f(l, now)
+	return ip, t.record(l)
+}
+
+// findFree returns the first address never used in the range,
+// or the first address no longer held.
+func (t *leaseTable) findFree(r *book.AddressRange, used map[uint32]bool, excluded func(ip net.IP) bool) net.IP {
+	start, end := ipToUint32(r.Start), ipToUint32(r.End)
+	var expired net.IP
+	for n := start; ; n++ {
+		ip := uint32ToIP(n)
+		if held, ok := used[n]; !excluded(ip) {
+			if !ok {
+				return ip
+			}
+			if !held && expired == nil {
+				expired = ip
+			}
+		}
+		if n == end {
+			return expired
+		}
+	}
+}
+
+// leaseDynamic leases an address of the dynamic range to the client.
+// See leaseTable.leaseDynamic.
+func (s *dhcp4Server) leaseDynamic(network *book.V4Network, hwaddr net.HardwareAddr, requested net.IP, options dhcp.Options, f func(l *Lease, now time.Time)) net.IP {
+	b := s.parent.book()
+	excluded := func(ip net.IP) bool {
+		if b.LookupInterfaceForIP(ip) != nil || ip.Equal(network.MyAddress) || ip.Equal(network.GatewayAddr) || s.parent.quarantine.contains(s.network, ip) {
+			return true
+		}
+		// Network and broadcast addresses.
+		ones, bits := network.Network.Mask.Size()
+		host := ipToUint32(ip) & (1<<uint(bits-ones) - 1)
+		return bits-ones > 1 && (host == 0 || host == 1<<uint(bits-ones)-1)
+	}
+	ip, err := s.parent.leases.leaseDynamic(s.network, hwaddr, network.DynamicRange, requested, excluded, withIdentity(options, f))
+	if err != nil {
+		s.reportJournalError(err)
+	}
+	return ip
+}
@@ -0,0 +1,114 @@
+package disq
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/ledyba/disq/book"
+)
+
+func TestDynamicRange(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	s := ds.parent
+	now := time.Date(2017, 4, 1, 9, 0, 0, 0, time.UTC)
+	s.leases.now = func() time.Time { return now }
+	unknown := []string{"02:00:00:00:00:01", "02:00:00:00:00:02", "02:00:00:00:00:03"}
+
+	// Static only by default.
+	if res := request(ds, dhcp.Discover, unknown[0], nil); res != nil {
+		t.Fatalf("Unknown machine got an offer: %v", res.YIAddr())
+	}
+
+	// 127.0.0.2 and 127.0.0.3 are assigned to aoba and hifumi.
+	s.book().V4Networks["loopback"].DynamicRange = &book.AddressRange{
+		Start: net.IPv4(127, 0, 0, 1).To4(),
+		End:   net.IPv4(127, 0, 0, 5).To4(),
+	}
+	res := request(ds, dhcp.Discover, unknown[0], nil)
+	if res == nil || !res.YIAddr().Equal(net.IPv4(127, 0, 0, 5)) {
+		t.Fatalf("Unexpected offer: %v", res)
+	}
+	first := append(net.IP(nil), res.YIAddr()...)
+	// Offered addresses are not given to the others.
+	if res := request(ds, dhcp.Discover, unknown[1], nil); res != nil {
+		t.Fatalf("Offered address is given again: %v", res.YIAddr())
+	}
+	// But the same client gets the same address.
+	if res := request(ds, dhcp.Discover, unknown[0], nil); res == nil || !res.YIAddr().Equal(first) {
+		t.Fatalf("Client got another address: %v", res)
+	}
+
+	res = request(ds, dhcp.Request, unknown[0], nil, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: first})
+	if res == nil || dhcp.MessageType(res.ParseOptions()[dhcp.OptionDHCPMessageType][0]) != dhcp.ACK {
+		t.Fatalf("Expected ACK, got %v", res)
+	}
+	// Addresses held by others are never given.
+	res = request(ds, dhcp.Request, unknown[1], nil, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: first})
+	if res == nil || dhcp.MessageType(res.ParseOptions()[dhcp.OptionDHCPMessageType][0]) != dhcp.NAK {
+		t.Fatalf("Expected NAK, got %v", res)
+	}
+	// Neither are static ones.
+	res = request(ds, dhcp.Request, unknown[1], nil, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: net.IPv4(127, 0, 0, 2).To4()})
+	if res == nil || dhcp.MessageType(res.ParseOptions()[dhcp.OptionDHCPMessageType][0]) != dhcp.NAK {
+		t.Fatalf("Expected NAK, got %v", res)
+	}
+
+	// The lease expires.
+	now = now.Add(25 * time.Hour)
+	if res := request(ds, dhcp.Discover, unknown[1], nil); res == nil || !res.YIAddr().Equal(first) {
+		t.Fatalf("Expired address is not reused: %v", res)
+	}
+
+	// Released addresses can be used at once.
+	res = request(ds, dhcp.Request, unknown[1], nil, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: first})
+	if res == nil || dhcp.MessageType(res.ParseOptions()[dhcp.OptionDHCPMessageType][0]) != dhcp.ACK {
+		t.Fatalf("Expected ACK, got %v", res)
+	}
+	if res := request(ds, dhcp.Discover, unknown[2], nil); res != nil {
+		t.Fatalf("Expected no address left, got %v", res.YIAddr())
+	}
+	request(ds, dhcp.Release, unknown[1], first)
+	if res := request(ds, dhcp.Discover, unknown[2], nil); res == nil || !res.YIAddr().Equal(first) {
+		t.Fatalf("Released address is not reused: %v", res)
+	}
+
+	// Machines in the book keep their addresses.
+	if res := discover(ds, "72:00:07:ef:42:80"); res == nil || !res.YIAddr().Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("Unexpected offer for aoba: %v", res)
+	}
+}
+
+func TestFindFree(t *testing.T) {
+	table := newLeaseTable()
+	r := &book.AddressRange{
+		Start: net.IPv4(10, 0, 0, 1).To4(),
+		End:   net.IPv4(10, 0, 0, 3).To4(),
+	}
+	never := func(net.IP) bool { return false }
+	used := map[uint32]bool{
+		ipToUint32(net.IPv4(10, 0, 0, 1)): false,
+		ipToUint32(net.IPv4(10, 0, 0, 2)): true,
+	}
+	// Addresses never used are preferred.
+	if ip := table.findFree(r, used, never); !ip.Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Errorf("Expected 10.0.0.3, got %v", ip)
+	}
+	used[ipToUint32(net.IPv4(10, 0, 0, 3))] = true
+	if ip := table.findFree(r, used, never); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Expected 10.0.0.1, got %v", ip)
+	}
+	used[ipToUint32(net.IPv4(10, 0, 0, 1))] = true
+	if ip := table.findFree(r, used, never); ip != nil {
+		t.Errorf("Expected nothing, got %v", ip)
+	}
+	// The range can end at the last address.
+	r = &book.AddressRange{
+		Start: net.IPv4(255, 255, 255, 255).To4(),
+		End:   net.IPv4(255, 255, 255, 255).To4(),
+	}
+	if ip := table.findFree(r, map[uint32]bool{}, never); !ip.Equal(net.IPv4(255, 255, 255, 255)) {
+		t.Errorf("Expected 255.255.255.255, got %v", ip)
+	}
+}
@@ -0,0 +1,122 @@
+package disq
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ledyba/disq/book"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// How long to wait for an answer before offering an address.
+const probeTimeout = 500 * time.Millisecond
+
+// Prober checks whether an address is already used by someone
+// before disq offers it.
+type Prober interface {
+	// Probe returns true if something answered at the address in the
+	// network within the timeout.
+	Probe(network *book.V4Network, ip net.IP, timeout time.Duration) (bool, error)
+}
+
+// ICMPProber sends ICMP echo requests. It keeps a raw socket for each
+// network probing addresses, opened at startup.
+type ICMPProber struct {
+	conns map[string]*icmpConn
+}
+
+type icmpConn struct {
+	mutex sync.Mutex // A probe at a time, not to read answers of the others.
+	conn  *icmp.PacketConn
+}
+
+func newICMPProber(b *book.Book) (*ICMPProber, error) {
+	p := &ICMPProber{
+		conns: make(map[string]*icmpConn),
+	}
+	for name, network := range b.V4Networks {
+		if !network.Probe {
+			continue
+		}
+		c, err := icmp.ListenPacket("ip4:icmp", network.MyAddress.String())
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("failed to open ICMP socket to probe addresses of %s: %v", name, err)
+		}
+		p.conns[name] = &icmpConn{conn: c}
+	}
+	return p, nil
+}
+
+func (p *ICMPProber) close() {
+	for _, c := range p.conns {
+		c.conn.Close()
+	}
+}
+
+func (p *ICMPProber) Probe(network *book.V4Network, ip net.IP, timeout time.Duration) (bool, error) {
+	ic, ok := p.conns[network.Name]
+	if !ok {
+		return false, fmt.Errorf("[BUG] ICMP socket is not opened for %s", network.Name)
+	}
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	c := ic.conn
+	id := os.Getpid() & 0xffff
+	seq := rand.Intn(0x10000)
+	req := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  seq,
+			Data: []byte("disq"),
+		},
+	}
+	dat, err := req.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := c.WriteTo(dat, &net.IPAddr{IP: ip}); err != nil {
+		return false, err
+	}
+	deadline := time.Now().Add(timeout)
+	buffer := make([]byte, 1500)
+	for {
+		c.SetReadDeadline(deadline)
+		n, addr, err := c.ReadFrom(buffer)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return false, nil
+			}
+			return false, err
+		}
+		// The raw socket receives every ICMP packet to the host.
+		from, ok := addr.(*net.IPAddr)
+		if !ok || !from.IP.Equal(ip) {
+			continue
+		}
+		res, err := icmp.ParseMessage(1, buffer[:n]) // 1 = ICMP for IPv4
+		if err != nil || res.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := res.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+			return true, nil
+		}
+	}
+}
+
+// OpenICMPProber opens raw sockets for the networks probing addresses,
+// and probes with them afterwards. Call it before Start.
+func (s *Server) OpenICMPProber() error {
+	p, err := newICMPProber(s.book())
+	if err != nil {
+		return err
+	}
+	s.Prober = p
+	return nil
+}
@@ -0,0 +1,94 @@
+package disq
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/ledyba/disq/book"
+)
+
+// testProber answers as if the addresses are used.
+type testProber struct {
+	used   map[string]bool
+	probed []string
+}
+
+func (p *testProber) Probe(network *book.V4Network, ip net.IP, timeout time.Duration) (bool, error) {
+	p.probed = append(p.probed, ip.String())
+	return p.used[ip.String()], nil
+}
+
+func TestProbeBeforeOffer(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	s := ds.parent
+	prober := &testProber{used: map[string]bool{"127.0.0.3": true}}
+	s.Prober = prober
+	network := s.book().V4Networks["loopback"]
+	network.ConflictCooldown = time.Minute
+
+	// Networks not configured to probe are not.
+	if res := discover(ds, "72:00:07:ef:42:82"); res == nil || len(prober.probed) != 0 {
+		t.Fatalf("Expected an offer without probing: %v", prober.probed)
+	}
+	network.Probe = true
+
+	// 127.0.0.2 is assigned to aoba, and nobody uses it.
+	if res := discover(ds, "72:00:07:ef:42:80"); res == nil {
+		t.Fatal("Expected an offer for aoba")
+	}
+	// Only the first offer is probed.
+	if res := discover(ds, "72:00:07:ef:42:80"); res == nil {
+		t.Fatal("Expected an offer for aoba")
+	}
+	if len(prober.probed) != 1 || prober.probed[0] != "127.0.0.2" {
+		t.Errorf("Unexpected probes: %v", prober.probed)
+	}
+
+	// 127.0.0.3 is assigned to hifumi, but someone answers.
+	if res := discover(ds, "72:00:07:ef:42:81"); res != nil {
+		t.Fatalf("Offer must be withheld, got %v", res.YIAddr())
+	}
+	select {
+	case err := <-s.ErrorStream:
+		conflict, ok := err.(*DHCP4AddressConflictError)
+		if !ok || !conflict.Addr.Equal(net.IPv4(127, 0, 0, 3)) || conflict.HardwareAddr.String() != "72:00:07:ef:42:81" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	default:
+		t.Error("Conflict is not reported")
+	}
+	// The address is in quarantine, and not probed again.
+	probed := len(prober.probed)
+	if res := discover(ds, "72:00:07:ef:42:81"); res != nil || len(prober.probed) != probed {
+		t.Errorf("Address in conflict must be in quarantine: %v", prober.probed)
+	}
+
+	// Offers of dynamic addresses are withdrawn, too.
+	s.book().V4Networks["loopback"].DynamicRange = &book.AddressRange{
+		Start: net.IPv4(127, 0, 0, 100).To4(),
+		End:   net.IPv4(127, 0, 0, 100).To4(),
+	}
+	prober.used["127.0.0.100"] = true
+	if res := request(ds, dhcp.Discover, "02:00:00:00:00:01", nil); res != nil {
+		t.Fatalf("Offer must be withheld, got %v", res.YIAddr())
+	}
+	<-s.ErrorStream
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	if l, _ := s.Lease("loopback", mac); l.IP != nil || !l.Offered.IsZero() {
+		t.Errorf("Offer is not withdrawn: %+v", l)
+	}
+}
+
+func TestICMPProberWithoutProbing(t *testing.T) {
+	s := newTestServer(t)
+	// No raw sockets are needed unless some network probes.
+	if err := s.OpenICMPProber(); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := s.Prober.(*ICMPProber)
+	if !ok || len(p.conns) != 0 {
+		t.Errorf("Unexpected prober: %+v", s.Prober)
+	}
+}
@@ -0,0 +1,78 @@
+package disq
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type quarantineKey struct {
+	network string
+	ip      string
+}
+
+// Addresses found in use by someone else. They are not offered until
+// their cool-down ends.
+type quarantine struct {
+	now func() time.Time
+
+	mutex sync.Mutex
+	until map[quarantineKey]time.Time
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{
+		now:   time.Now,
+		until: make(map[quarantineKey]time.Time),
+	}
+}
+
+func (q *quarantine) add(network string, ip net.IP, cooldown time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.until[quarantineKey{network, string(ip.To4())}] = q.now().Add(cooldown)
+}
+
+func (q *quarantine) contains(network string, ip net.IP) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	key := quarantineKey{network, string(ip.To4())}
+	until, ok := q.until[key]
+	if !ok {
+		return false
+	}
+	if !q.now().Before(until) {
+		delete(q.until, key)
+		return false
+	}
+	return true
+}
+
+// addrs returns the addresses in quarantine in the network, sorted.
+func (q *quarantine) addrs(network string) []net.IP {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := q.now()
+	var ips []net.IP
+	for key, until := range q.until {
+		if !now.Before(until) {
+			delete(q.until, key)
+			continue
+		}
+		if key.network == network {
+			ips = append(ips, net.IP(key.ip))
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i], ips[j]) < 0
+	})
+	return ips
+}
+
+// QuarantinedAddrs returns the addresses in the network which are not
+// offered because they were found in use.
+func (s *Server) QuarantinedAddrs(network string) []net.IP {
+	return s.quarantine.addrs(network)
+}
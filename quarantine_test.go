@@ -0,0 +1,91 @@
+package disq
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/ledyba/disq/book"
+)
+
+func TestDecline(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	s := ds.parent
+	now := time.Date(2017, 4, 1, 9, 0, 0, 0, time.UTC)
+	s.quarantine.now = func() time.Time { return now }
+	network := s.book().V4Networks["loopback"]
+	network.ConflictCooldown = 10 * time.Minute
+	aoba := net.IPv4(127, 0, 0, 2).To4()
+
+	request(ds, dhcp.Decline, "72:00:07:ef:42:80", nil,
+		dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: aoba},
+		dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: network.MyAddress},
+		dhcp.Option{Code: dhcp.OptionMessage, Value: []byte("arp reply received")})
+	select {
+	case err := <-s.ErrorStream:
+		decline, ok := err.(*DHCP4DeclineError)
+		if !ok || !decline.Addr.Equal(aoba) || decline.Message != "arp reply received" || decline.Network != "loopback" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	default:
+		t.Fatal("Decline is not reported")
+	}
+	if ips := s.QuarantinedAddrs("loopback"); len(ips) != 1 || !ips[0].Equal(aoba) {
+		t.Errorf("Unexpected quarantine: %v", ips)
+	}
+	mac, _ := net.ParseMAC("72:00:07:ef:42:80")
+	if l, _ := s.Lease("loopback", mac); l.Declined.IsZero() || !l.IP.Equal(aoba) {
+		t.Errorf("Decline is not recorded: %+v", l)
+	}
+
+	// Not offered again during the cool-down.
+	if res := discover(ds, "72:00:07:ef:42:80"); res != nil {
+		t.Fatalf("Offer must be withheld, got %v", res.YIAddr())
+	}
+	now = now.Add(10 * time.Minute)
+	if res := discover(ds, "72:00:07:ef:42:80"); res == nil || !res.YIAddr().Equal(aoba) {
+		t.Fatalf("Expected an offer after the cool-down, got %v", res)
+	}
+	if ips := s.QuarantinedAddrs("loopback"); len(ips) != 0 {
+		t.Errorf("Quarantine must end: %v", ips)
+	}
+
+	// Declines for other servers are ignored.
+	request(ds, dhcp.Decline, "72:00:07:ef:42:80", nil,
+		dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: aoba},
+		dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: []byte{192, 0, 2, 1}})
+	if ips := s.QuarantinedAddrs("loopback"); len(ips) != 0 {
+		t.Errorf("Decline for another server must be ignored: %v", ips)
+	}
+
+	// Addresses not given to the client can not be declined.
+	request(ds, dhcp.Decline, "02:00:00:00:00:09", nil,
+		dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: aoba},
+		dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: network.MyAddress})
+	select {
+	case err := <-s.ErrorStream:
+		t.Errorf("Decline of an address of another machine must be ignored: %v", err)
+	default:
+	}
+	if ips := s.QuarantinedAddrs("loopback"); len(ips) != 0 {
+		t.Errorf("Decline of an address of another machine must be ignored: %v", ips)
+	}
+
+	// Dynamic clients get another address.
+	network.DynamicRange = &book.AddressRange{
+		Start: net.IPv4(127, 0, 0, 100).To4(),
+		End:   net.IPv4(127, 0, 0, 101).To4(),
+	}
+	res := request(ds, dhcp.Discover, "02:00:00:00:00:01", nil)
+	if res == nil {
+		t.Fatal("Expected an offer")
+	}
+	declined := append(net.IP(nil), res.YIAddr()...)
+	request(ds, dhcp.Decline, "02:00:00:00:00:01", nil, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: declined})
+	<-s.ErrorStream
+	res = request(ds, dhcp.Discover, "02:00:00:00:00:01", nil)
+	if res == nil || res.YIAddr().Equal(declined) {
+		t.Fatalf("Expected another address than %v, got %v", declined, res)
+	}
+}
@@ -0,0 +1,77 @@
+package disq
+
+import (
+	"net"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/ledyba/disq/book"
+)
+
+// Port of DHCP servers, which relay agents also listen on.
+const dhcp4ServerPort = 67
+
+// Sub-options of Relay Agent Information option. See RFC 3046.
+const (
+	relayAgentCircuitID = 1
+	relayAgentRemoteID  = 2
+)
+
+// relayConn sends replies for relayed requests back to the relay agents,
+// instead of the address the requests came from or broadcast.
+type relayConn struct {
+	dhcp4conn
+}
+
+func (c *relayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if p := dhcp.Packet(b); len(p) >= 240 {
+		if giaddr := p.GIAddr(); !giaddr.Equal(net.IPv4zero) {
+			addr = &net.UDPAddr{
+				IP:   append(net.IP(nil), giaddr...),
+				Port: dhcp4ServerPort,
+			}
+		}
+	}
+	return c.dhcp4conn.WriteTo(b, addr)
+}
+
+// parseRelayAgentInfo returns Circuit ID and Remote ID in the option.
+// They are nil if not found.
+func parseRelayAgentInfo(b []byte) (circuitID, remoteID []byte) {
+	for i := 0; i+2 <= len(b); {
+		code, length := b[i], int(b[i+1])
+		if i+2+length > len(b) {
+			break
+		}
+		switch code {
+		case relayAgentCircuitID:
+			circuitID = b[i+2 : i+2+length]
+		case relayAgentRemoteID:
+			remoteID = b[i+2 : i+2+length]
+		}
+		i += 2 + length
+	}
+	return
+}
+
+// relayedNetwork returns the name of the network the relay agent belongs to,
+// which must be served via the interface of the network receiving the packet.
+func relayedNetwork(b *book.Book, receiver *book.V4Network, giaddr net.IP) (string, bool) {
+	for name, network := range b.V4Networks {
+		if network.Network.Contains(giaddr) && network.Interface != nil && receiver.Interface != nil && network.Interface.Name == receiver.Interface.Name {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// matchesRelayAgent reports whether the request came via the relay agent
+// port configured for the interface.
+func matchesRelayAgent(nic *book.Interface, circuitID, remoteID []byte) bool {
+	if len(nic.RelayCircuitID) > 0 && nic.RelayCircuitID != string(circuitID) {
+		return false
+	}
+	if len(nic.RelayRemoteID) > 0 && nic.RelayRemoteID != string(remoteID) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package disq
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/ledyba/disq/book"
+)
+
+func relayed(ds *dhcp4Server, msgType dhcp.MessageType, hwaddr string, giaddr net.IP, circuitID, remoteID string) dhcp.Packet {
+	mac, _ := net.ParseMAC(hwaddr)
+	info := append([]byte{relayAgentCircuitID, byte(len(circuitID))}, circuitID...)
+	info = append(append(info, relayAgentRemoteID, byte(len(remoteID))), remoteID...)
+	p := dhcp.RequestPacket(msgType, mac, nil, []byte{1, 2, 3, 4}, true, []dhcp.Option{
+		{Code: dhcp.OptionRelayAgentInformation, Value: info},
+	})
+	p.SetGIAddr(giaddr)
+	return ds.ServeDHCP(p, msgType, p.ParseOptions())
+}
+
+func TestParseRelayAgentInfo(t *testing.T) {
+	circuitID, remoteID := parseRelayAgentInfo([]byte{1, 3, 'a', 'b', 'c', 9, 1, 0, 2, 2, 'x', 'y'})
+	if string(circuitID) != "abc" || string(remoteID) != "xy" {
+		t.Errorf("Unexpected sub-options: %q, %q", circuitID, remoteID)
+	}
+	circuitID, remoteID = parseRelayAgentInfo([]byte{1, 10, 'a'})
+	if circuitID != nil || remoteID != nil {
+		t.Errorf("Broken option must be ignored: %q, %q", circuitID, remoteID)
+	}
+}
+
+type testPacketConn struct {
+	dhcp4conn
+	to net.Addr
+}
+
+func (c *testPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.to = addr
+	return len(b), nil
+}
+
+func TestRelayConn(t *testing.T) {
+	mac, _ := net.ParseMAC("72:00:07:ef:42:80")
+	c := &testPacketConn{}
+	rc := &relayConn{c}
+	p := dhcp.RequestPacket(dhcp.Discover, mac, nil, []byte{1, 2, 3, 4}, true, nil)
+	broadcast := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	rc.WriteTo(p, broadcast)
+	if c.to != broadcast {
+		t.Errorf("Replies not relayed must be sent as they are, got %v", c.to)
+	}
+	p.SetGIAddr(net.IPv4(10, 1, 0, 1))
+	rc.WriteTo(p, broadcast)
+	if to, ok := c.to.(*net.UDPAddr); !ok || !to.IP.Equal(net.IPv4(10, 1, 0, 1)) || to.Port != 67 {
+		t.Errorf("Replies must be sent to the relay agent, got %v", c.to)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	ds := newTestDHCP4Server(t)
+	b := ds.parent.book()
+	lo := &net.Interface{Name: "lo"}
+	loopback := b.V4Networks["loopback"]
+	loopback.Interface = lo
+	_, rack, _ := net.ParseCIDR("10.1.0.0/24")
+	b.V4Networks["rack1"] = &book.V4Network{
+		Name:              "rack1",
+		Interface:         lo,
+		MyAddress:         loopback.MyAddress,
+		Network:           rack,
+		GatewayAddr:       net.IPv4(10, 1, 0, 1).To4(),
+		LeaseDurationDays: 1.0,
+		Relayed:           true,
+		DynamicRange: &book.AddressRange{
+			Start: net.IPv4(10, 1, 0, 100).To4(),
+			End:   net.IPv4(10, 1, 0, 100).To4(),
+		},
+	}
+
+	// The network is chosen by giaddr.
+	res := relayed(ds, dhcp.Discover, "02:00:00:00:00:01", net.IPv4(10, 1, 0, 1).To4(), "Gi1/0/1", "tor-1")
+	if res == nil || !res.YIAddr().Equal(net.IPv4(10, 1, 0, 100)) {
+		t.Fatalf("Unexpected offer: %v", res)
+	}
+	opts := res.ParseOptions()
+	if router := net.IP(opts[dhcp.OptionRouter]); !router.Equal(net.IPv4(10, 1, 0, 1)) {
+		t.Errorf("Expected the router of rack1, got %v", router)
+	}
+	if !res.GIAddr().Equal(net.IPv4(10, 1, 0, 1)) {
+		t.Errorf("giaddr must be kept, got %v", res.GIAddr())
+	}
+	codes := optionCodes(res)
+	if codes[len(codes)-1] != dhcp.OptionRelayAgentInformation {
+		t.Errorf("Relay Agent Information must be echoed at last: %v", codes)
+	}
+	if circuitID, _ := parseRelayAgentInfo(opts[dhcp.OptionRelayAgentInformation]); !bytes.Equal(circuitID, []byte("Gi1/0/1")) {
+		t.Errorf("Unexpected circuit-id: %q", circuitID)
+	}
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	if _, ok := ds.parent.Lease("rack1", mac); !ok {
+		t.Error("Lease must be recorded in rack1")
+	}
+
+	// Unknown relay agents are ignored.
+	if res := relayed(ds, dhcp.Discover, "02:00:00:00:00:01", net.IPv4(10, 2, 0, 1).To4(), "Gi1/0/1", "tor-2"); res != nil {
+		t.Errorf("Unexpected offer: %v", res.YIAddr())
+	}
+
+	// Requests must come via the port configured for the interface.
+	aoba, _ := net.ParseMAC("72:00:07:ef:42:80")
+	b.LookupInterfaceForHardwareAddr(aoba).RelayCircuitID = "Gi1/0/1"
+	if res := relayed(ds, dhcp.Discover, aoba.String(), net.IPv4(127, 0, 0, 254).To4(), "Gi1/0/2", "tor-1"); res != nil {
+		t.Errorf("Request via another port must be ignored, got %v", res.YIAddr())
+	}
+	res = relayed(ds, dhcp.Discover, aoba.String(), net.IPv4(127, 0, 0, 254).To4(), "Gi1/0/1", "tor-1")
+	if res == nil || !res.YIAddr().Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("Unexpected offer: %v", res)
+	}
+}
@@ -9,14 +9,25 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/ledyba/disq/book"
+	"github.com/ledyba/disq/tftp"
 	"github.com/miekg/dns"
 )
 
 type Server struct {
-	bookPtr atomic.Value
+	bookPtr    atomic.Value
+	cachePtr   atomic.Value
+	rotation   uint32 // for round-robin answers
+	leases     *leaseTable
+	quarantine *quarantine
 
-	dns   *dns.Server
+	dns   []*dns.Server // UDP and TCP
 	dhcp4 map[string]*dhcp4Server
+	dhcp6 map[string]*dhcp6Server
+	tftp  map[string]*tftp.Server
+
+	// Probes addresses before offering them, for the networks configured so.
+	// nil disables probing. See OpenICMPProber.
+	Prober Prober
 
 	ErrorStream chan error
 
@@ -31,16 +42,37 @@ func (s *Server) book() *book.Book {
 	return s.bookPtr.Load().(*book.Book)
 }
 
+func (s *Server) storeCache(c *dnsCache) {
+	s.cachePtr.Store(c)
+}
+func (s *Server) cache() *dnsCache {
+	return s.cachePtr.Load().(*dnsCache)
+}
+
+// DNSCacheStats reports how the cache for upstream answers is working.
+func (s *Server) DNSCacheStats() DNSCacheStats {
+	c := s.cache()
+	if c == nil {
+		return DNSCacheStats{}
+	}
+	return c.stats()
+}
+
 func FromBook(book *book.Book) *Server {
 	s := &Server{}
 	s.storeBook(book)
+	s.storeCache(newDNSCache(book.DNS.Cache))
+	s.leases = newLeaseTable()
+	s.quarantine = newQuarantine()
 	s.ErrorStream = make(chan error, 1)
 	// DNS
 	if len(book.DNS.Listen) > 0 {
-		s.dns = &dns.Server{
-			Handler: s,
-			Addr:    book.DNS.Listen,
-			Net:     "udp",
+		for _, network := range []string{"udp", "tcp"} {
+			s.dns = append(s.dns, &dns.Server{
+				Handler: s,
+				Addr:    book.DNS.Listen,
+				Net:     network,
+			})
 		}
 	}
 	// DHCP
@@ -52,19 +84,35 @@ func FromBook(book *book.Book) *Server {
 			s.dhcp4[networkName] = ds
 		}
 	}
+	s.dhcp6 = make(map[string]*dhcp6Server)
+	for networkName, network := range book.V6Networks {
+		if len(network.DHCP6Listen) > 0 {
+			s.dhcp6[networkName] = newDHCP6Server(s, networkName)
+		}
+	}
+	// TFTP
+	s.tftp = make(map[string]*tftp.Server)
+	for networkName, network := range book.V4Networks {
+		if len(network.TFTPListen) > 0 {
+			s.tftp[networkName] = &tftp.Server{
+				Root: network.TFTPRoot,
+			}
+		}
+	}
 	return s
 }
 
 func (s *Server) Start() {
-	if s.dns != nil {
-		go func() {
-			s.doneWg.Add(1)
+	for _, ds := range s.dns {
+		s.doneWg.Add(1)
+		go func(ds *dns.Server) {
 			defer s.doneWg.Done()
 			for atomic.LoadInt32(&s.done) == 0 {
 				log.
 					WithField("Module", "DNS").
-					Infof("Seaving @ %s", s.dns.Addr)
-				err := s.dns.ListenAndServe()
+					WithField("Net", ds.Net).
+					Infof("Seaving @ %s", ds.Addr)
+				err := ds.ListenAndServe()
 				if err != nil {
 					err = &DNSError{
 						Err: err,
@@ -74,12 +122,13 @@ func (s *Server) Start() {
 			}
 			log.
 				WithField("Module", "DNS").
+				WithField("Net", ds.Net).
 				Info("Stopped")
-		}()
+		}(ds)
 	}
 	for networkName, ds := range s.dhcp4 {
-		go func(networkName string) {
-			s.doneWg.Add(1)
+		s.doneWg.Add(1)
+		go func(networkName string, ds *dhcp4Server) {
 			defer s.doneWg.Done()
 			for atomic.LoadInt32(&s.done) == 0 {
 				err := ds.Serve()
@@ -92,7 +141,49 @@ func (s *Server) Start() {
 				}
 			}
 			ds.log().Info("Stopped")
-		}(networkName)
+		}(networkName, ds)
+	}
+	for networkName, ds := range s.dhcp6 {
+		s.doneWg.Add(1)
+		go func(networkName string, ds *dhcp6Server) {
+			defer s.doneWg.Done()
+			for atomic.LoadInt32(&s.done) == 0 {
+				err := ds.Serve()
+				if err != nil {
+					err = &DHCP6Error{
+						Network: networkName,
+						Err:     err,
+					}
+					s.ErrorStream <- err
+				}
+			}
+			ds.log().Info("Stopped")
+		}(networkName, ds)
+	}
+	for networkName, ts := range s.tftp {
+		s.doneWg.Add(1)
+		go func(networkName string, ts *tftp.Server) {
+			defer s.doneWg.Done()
+			listen := s.book().V4Networks[networkName].TFTPListen
+			for atomic.LoadInt32(&s.done) == 0 {
+				log.
+					WithField("Module", "TFTP").
+					WithField("Network", networkName).
+					Infof("Seaving %s @ %s", ts.Root, listen)
+				err := ts.ListenAndServe(listen)
+				if err != nil {
+					err = &TFTPError{
+						Network: networkName,
+						Err:     err,
+					}
+					s.ErrorStream <- err
+				}
+			}
+			log.
+				WithField("Module", "TFTP").
+				WithField("Network", networkName).
+				Info("Stopped")
+		}(networkName, ts)
 	}
 }
 
@@ -100,11 +191,12 @@ func (s *Server) Start() {
 func (s *Server) Stop() {
 	var err error
 	atomic.StoreInt32(&s.done, 1)
-	if s.dns != nil {
+	for _, ds := range s.dns {
 		log.
 			WithField("Module", "DNS").
+			WithField("Net", ds.Net).
 			Info("Shutdown requested")
-		err = s.dns.Shutdown()
+		err = ds.Shutdown()
 		if err != nil {
 			err = &DNSError{
 				Err: err,
@@ -113,6 +205,7 @@ func (s *Server) Stop() {
 		}
 		log.
 			WithField("Module", "DNS").
+			WithField("Net", ds.Net).
 			Info("Shutdown succeeded")
 	}
 	for network, ds := range s.dhcp4 {
@@ -127,16 +220,54 @@ func (s *Server) Stop() {
 		}
 		ds.log().Info("shutdown succeeded")
 	}
+	for network, ds := range s.dhcp6 {
+		ds.log().Info("shutdown requested")
+		err = ds.Shutdown()
+		if err != nil {
+			err = &DHCP6Error{
+				Network: network,
+				Err:     err,
+			}
+			s.ErrorStream <- err
+		}
+		ds.log().Info("shutdown succeeded")
+	}
+	for network, ts := range s.tftp {
+		tlog := log.WithField("Module", "TFTP").WithField("Network", network)
+		tlog.Info("shutdown requested")
+		err = ts.Shutdown()
+		if err != nil {
+			err = &TFTPError{
+				Network: network,
+				Err:     err,
+			}
+			s.ErrorStream <- err
+		}
+		tlog.Info("shutdown succeeded")
+	}
 	log.WithField("Module", "Server").Info("Waiting for shutting down all servers.")
 	s.doneWg.Wait()
+	if p, ok := s.Prober.(*ICMPProber); ok {
+		p.close()
+	}
+	err = s.leases.closeJournal()
+	if err != nil {
+		s.ErrorStream <- &LeaseJournalError{
+			Err: err,
+		}
+	}
 }
 
 // Reload book.
 // But do not stop server.
 func (s *Server) Reload(b *book.Book) error {
 	// DNS
-	if b.DNS.Listen != s.dns.Addr {
-		return fmt.Errorf("can't change DNS listening address at this version: %s, %s", b.DNS.Listen, s.dns.Addr)
+	listen := ""
+	if len(s.dns) > 0 {
+		listen = s.dns[0].Addr
+	}
+	if b.DNS.Listen != listen {
+		return fmt.Errorf("can't change DNS listening address at this version: %s, %s", b.DNS.Listen, listen)
 	}
 	// DHCP
 	dhcp4Cnt := 0
@@ -151,6 +282,43 @@ func (s *Server) Reload(b *book.Book) error {
 	if dhcp4Cnt != len(s.dhcp4) {
 		return fmt.Errorf("can't remove DHCP4 servers at this version: %d -> %d", len(s.dhcp4), dhcp4Cnt)
 	}
+	dhcp6Cnt := 0
+	for name, network := range b.V6Networks {
+		if len(network.DHCP6Listen) > 0 {
+			dhcp6Cnt++
+			if _, ok := s.dhcp6[name]; !ok {
+				return fmt.Errorf("can't add new DHCP6 servers at this version: %s, %s", name, network.DHCP6Listen)
+			}
+		}
+	}
+	if dhcp6Cnt != len(s.dhcp6) {
+		return fmt.Errorf("can't remove DHCP6 servers at this version: %d -> %d", len(s.dhcp6), dhcp6Cnt)
+	}
+	// TFTP
+	tftpCnt := 0
+	for name, network := range b.V4Networks {
+		if len(network.TFTPListen) > 0 {
+			tftpCnt++
+			ts, ok := s.tftp[name]
+			if !ok {
+				return fmt.Errorf("can't add new TFTP servers at this version: %s, %s", name, network.TFTPListen)
+			}
+			if old := s.book().V4Networks[name]; old.TFTPListen != network.TFTPListen || ts.Root != network.TFTPRoot {
+				return fmt.Errorf("can't change TFTP servers at this version: %s", name)
+			}
+		}
+	}
+	if tftpCnt != len(s.tftp) {
+		return fmt.Errorf("can't remove TFTP servers at this version: %d -> %d", len(s.tftp), tftpCnt)
+	}
+	// Probing: sockets are opened only at startup.
+	for name, network := range b.V4Networks {
+		if old, ok := s.book().V4Networks[name]; network.Probe && (!ok || !old.Probe) {
+			return fmt.Errorf("can't start probing addresses at this version: %s", name)
+		}
+	}
+	// Upstreams may be changed, so cached answers are no longer reliable.
+	s.storeCache(newDNSCache(b.DNS.Cache))
 	s.storeBook(b)
 	return nil
 }
@@ -0,0 +1,194 @@
+// Package tftp implements a read-only TFTP server (RFC 1350) with option
+// negotiation (RFC 2347) for blksize (RFC 2348), timeout and tsize (RFC 2349),
+// which disq uses to serve boot loaders.
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrPacketTooShort = errors.New("tftp: packet too short")
+	ErrMalformed      = errors.New("tftp: malformed packet")
+)
+
+type Opcode uint16
+
+const (
+	OpRRQ   Opcode = 1
+	OpWRQ   Opcode = 2
+	OpDATA  Opcode = 3
+	OpACK   Opcode = 4
+	OpERROR Opcode = 5
+	OpOACK  Opcode = 6
+)
+
+type ErrorCode uint16
+
+const (
+	ErrNotDefined       ErrorCode = 0
+	ErrFileNotFound     ErrorCode = 1
+	ErrAccessViolation  ErrorCode = 2
+	ErrDiskFull         ErrorCode = 3
+	ErrIllegalOperation ErrorCode = 4
+	ErrUnknownTID       ErrorCode = 5
+	ErrFileExists       ErrorCode = 6
+	ErrNoSuchUser       ErrorCode = 7
+	ErrOptionRefused    ErrorCode = 8
+)
+
+const (
+	DefaultBlockSize = 512
+	MinBlockSize     = 8
+	MaxBlockSize     = 65464
+)
+
+// Request is RRQ or WRQ.
+type Request struct {
+	Opcode   Opcode
+	Filename string
+	Mode     string // lowercase
+	// Options in lowercase. Unknown options are kept, and ignored by the server.
+	Options map[string]string
+}
+
+func parseOpcode(b []byte) (Opcode, error) {
+	if len(b) < 2 {
+		return 0, ErrPacketTooShort
+	}
+	return Opcode(binary.BigEndian.Uint16(b)), nil
+}
+
+func ParseRequest(b []byte) (*Request, error) {
+	op, err := parseOpcode(b)
+	if err != nil {
+		return nil, err
+	}
+	if op != OpRRQ && op != OpWRQ {
+		return nil, ErrMalformed
+	}
+	fields := bytes.Split(b[2:], []byte{0})
+	// The packet ends with NUL, so the last field is always empty.
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, ErrMalformed
+	}
+	fields = fields[:len(fields)-1]
+	if len(fields)%2 != 0 {
+		return nil, ErrMalformed
+	}
+	req := &Request{
+		Opcode:   op,
+		Filename: string(fields[0]),
+		Mode:     strings.ToLower(string(fields[1])),
+		Options:  make(map[string]string),
+	}
+	for i := 2; i+1 < len(fields); i += 2 {
+		req.Options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return req, nil
+}
+
+func (r *Request) Marshal() []byte {
+	b := make([]byte, 2, 512)
+	binary.BigEndian.PutUint16(b, uint16(r.Opcode))
+	b = append(append(b, r.Filename...), 0)
+	b = append(append(b, r.Mode...), 0)
+	for name, value := range r.Options {
+		b = append(append(b, name...), 0)
+		b = append(append(b, value...), 0)
+	}
+	return b
+}
+
+func marshalData(block uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(b[0:2], uint16(OpDATA))
+	binary.BigEndian.PutUint16(b[2:4], block)
+	return append(b, data...)
+}
+
+// ParseData returns the block number and the data.
+func ParseData(b []byte) (uint16, []byte, error) {
+	op, err := parseOpcode(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if op != OpDATA || len(b) < 4 {
+		return 0, nil, ErrMalformed
+	}
+	return binary.BigEndian.Uint16(b[2:4]), b[4:], nil
+}
+
+func MarshalACK(block uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[0:2], uint16(OpACK))
+	binary.BigEndian.PutUint16(b[2:4], block)
+	return b
+}
+
+func parseACK(b []byte) (uint16, error) {
+	op, err := parseOpcode(b)
+	if err != nil {
+		return 0, err
+	}
+	if op != OpACK || len(b) < 4 {
+		return 0, ErrMalformed
+	}
+	return binary.BigEndian.Uint16(b[2:4]), nil
+}
+
+func marshalError(code ErrorCode, msg string) []byte {
+	b := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(b[0:2], uint16(OpERROR))
+	binary.BigEndian.PutUint16(b[2:4], uint16(code))
+	return append(append(b, msg...), 0)
+}
+
+// ParseError returns the error code and the message of ERROR packet.
+func ParseError(b []byte) (ErrorCode, string, error) {
+	op, err := parseOpcode(b)
+	if err != nil {
+		return 0, "", err
+	}
+	if op != OpERROR || len(b) < 5 {
+		return 0, "", ErrMalformed
+	}
+	return ErrorCode(binary.BigEndian.Uint16(b[2:4])), string(bytes.TrimRight(b[4:], "\x00")), nil
+}
+
+// marshalOACK encodes the options in the order of names.
+func marshalOACK(names []string, options map[string]string) []byte {
+	b := make([]byte, 2, 512)
+	binary.BigEndian.PutUint16(b, uint16(OpOACK))
+	for _, name := range names {
+		b = append(append(b, name...), 0)
+		b = append(append(b, options[name]...), 0)
+	}
+	return b
+}
+
+// ParseOACK returns the options acknowledged by the server.
+func ParseOACK(b []byte) (map[string]string, error) {
+	op, err := parseOpcode(b)
+	if err != nil {
+		return nil, err
+	}
+	if op != OpOACK {
+		return nil, ErrMalformed
+	}
+	options := make(map[string]string)
+	fields := bytes.Split(b[2:], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return options, nil
+}
+
+func atoi(s string) (int, bool) {
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
@@ -0,0 +1,276 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	DefaultTimeout = time.Second
+	DefaultRetries = 5
+)
+
+var (
+	errNotFound        = errors.New("file not found")
+	errAccessViolation = errors.New("access violation")
+)
+
+// Server serves files under Root. Writing is never allowed.
+type Server struct {
+	Root    string
+	Timeout time.Duration // 0 means DefaultTimeout. Clients can change it by timeout option.
+	Retries int           // 0 means DefaultRetries.
+
+	mutex    sync.Mutex
+	conn     net.PacketConn
+	shutdown int32
+}
+
+func (s *Server) log() *log.Entry {
+	return log.WithField("Module", "TFTP")
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve reads requests from the conn, and answers each of them from
+// a new port (TID) in its own goroutine. It returns nil after Shutdown.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mutex.Lock()
+	if atomic.LoadInt32(&s.shutdown) != 0 {
+		s.mutex.Unlock()
+		conn.Close()
+		return nil
+	}
+	s.conn = conn
+	s.mutex.Unlock()
+
+	var localIP net.IP
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		localIP = addr.IP
+	}
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if atomic.LoadInt32(&s.shutdown) != 0 {
+				return nil
+			}
+			return err
+		}
+		req, err := ParseRequest(buffer[:n])
+		if err != nil {
+			s.log().WithError(err).Debugf("Invalid request from %s", addr)
+			continue
+		}
+		go s.serveRequest(req, addr, localIP)
+	}
+}
+
+// Shutdown stops accepting new requests. Transfers in progress are left
+// to finish or time out. The server can't be started again.
+func (s *Server) Shutdown() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt32(&s.shutdown, 1)
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// open opens the file under the root. The name is always treated as
+// relative to the root, and symbolic links out of the root are not followed.
+func (s *Server) open(name string) (*os.File, int64, error) {
+	// Some PXE clients use backslashes.
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	root, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		return nil, 0, err
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, 0, errNotFound
+	}
+	if rel, err := filepath.Rel(root, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, 0, errAccessViolation
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil, 0, errAccessViolation
+		}
+		return nil, 0, errNotFound
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, errNotFound
+	}
+	return f, fi.Size(), nil
+}
+
+// transfer is a connection to the client, bound to a new port.
+type transfer struct {
+	conn    net.PacketConn
+	peer    net.Addr
+	timeout time.Duration
+	retries int
+}
+
+func (t *transfer) sendError(code ErrorCode, msg string) {
+	t.conn.WriteTo(marshalError(code, msg), t.peer)
+}
+
+// send sends the packet and waits for ACK of the block, resending the
+// packet when timed out.
+func (t *transfer) send(packet []byte, block uint16) error {
+	buffer := make([]byte, 1500)
+	for retry := 0; retry <= t.retries; retry++ {
+		if _, err := t.conn.WriteTo(packet, t.peer); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(t.timeout)
+		for {
+			t.conn.SetReadDeadline(deadline)
+			n, addr, err := t.conn.ReadFrom(buffer)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return err
+			}
+			if addr.String() != t.peer.String() {
+				t.conn.WriteTo(marshalError(ErrUnknownTID, "unknown transfer id"), addr)
+				continue
+			}
+			if code, msg, err := ParseError(buffer[:n]); err == nil {
+				return fmt.Errorf("client sent error %d: %s", code, msg)
+			}
+			ack, err := parseACK(buffer[:n])
+			if err != nil {
+				t.sendError(ErrIllegalOperation, "ACK expected")
+				return err
+			}
+			if ack == block {
+				return nil
+			}
+			// Duplicated ACK. Never resend, to avoid Sorcerer's Apprentice Syndrome.
+		}
+	}
+	return fmt.Errorf("timed out waiting for ACK of block %d", block)
+}
+
+func (s *Server) serveRequest(req *Request, peer net.Addr, localIP net.IP) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		s.log().WithError(err).Error("Failed to open a port for transfer")
+		return
+	}
+	defer conn.Close()
+	t := &transfer{
+		conn:    conn,
+		peer:    peer,
+		timeout: s.Timeout,
+		retries: s.Retries,
+	}
+	if t.timeout <= 0 {
+		t.timeout = DefaultTimeout
+	}
+	if t.retries <= 0 {
+		t.retries = DefaultRetries
+	}
+	if req.Opcode == OpWRQ {
+		s.log().Warnf("Write request from %s refused: %s", peer, req.Filename)
+		t.sendError(ErrAccessViolation, "read only")
+		return
+	}
+	if req.Mode != "octet" {
+		t.sendError(ErrIllegalOperation, "only octet mode is supported")
+		return
+	}
+	f, size, err := s.open(req.Filename)
+	if err != nil {
+		s.log().WithError(err).Warnf("Can't send %s to %s", req.Filename, peer)
+		if err == errAccessViolation {
+			t.sendError(ErrAccessViolation, err.Error())
+		} else {
+			t.sendError(ErrFileNotFound, errNotFound.Error())
+		}
+		return
+	}
+	defer f.Close()
+
+	// Option negotiation. See RFC 2347.
+	blockSize := DefaultBlockSize
+	accepted := make(map[string]string)
+	if v, ok := req.Options["blksize"]; ok {
+		if n, ok := atoi(v); ok && n >= MinBlockSize {
+			if n > MaxBlockSize {
+				n = MaxBlockSize
+			}
+			blockSize = n
+			accepted["blksize"] = strconv.Itoa(n)
+		}
+	}
+	if v, ok := req.Options["timeout"]; ok {
+		if n, ok := atoi(v); ok && n >= 1 && n <= 255 {
+			t.timeout = time.Duration(n) * time.Second
+			accepted["timeout"] = v
+		}
+	}
+	if _, ok := req.Options["tsize"]; ok {
+		accepted["tsize"] = strconv.FormatInt(size, 10)
+	}
+	if len(accepted) > 0 {
+		names := make([]string, 0, len(accepted))
+		for name := range accepted {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if err := t.send(marshalOACK(names, accepted), 0); err != nil {
+			s.log().WithError(err).Warnf("Failed to negotiate options with %s", peer)
+			return
+		}
+	}
+
+	s.log().Infof("Sending %s (%d bytes) to %s", req.Filename, size, peer)
+	buffer := make([]byte, blockSize)
+	// Block numbers wrap around for files larger than 65535 blocks.
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(f, buffer)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			s.log().WithError(err).Errorf("Failed to read %s", req.Filename)
+			t.sendError(ErrNotDefined, "read error")
+			return
+		}
+		if err := t.send(marshalData(block, buffer[:n]), block); err != nil {
+			s.log().WithError(err).Warnf("Failed to send %s to %s", req.Filename, peer)
+			return
+		}
+		if last {
+			return
+		}
+	}
+}
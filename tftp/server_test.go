@@ -0,0 +1,199 @@
+package tftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T) (*Server, string) {
+	root, err := ioutil.TempDir("", "disq-tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Root: root, Timeout: 200 * time.Millisecond, Retries: 2}
+	go s.Serve(conn)
+	t.Cleanup(func() {
+		s.Shutdown()
+		os.RemoveAll(root)
+	})
+	return s, conn.LocalAddr().String()
+}
+
+// get reads the file like a client, and returns the content and OACK.
+func get(t *testing.T, addr string, req *Request) ([]byte, map[string]string, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(req.Marshal(), server); err != nil {
+		t.Fatal(err)
+	}
+	var content bytes.Buffer
+	var oack map[string]string
+	blockSize := DefaultBlockSize
+	buffer := make([]byte, MaxBlockSize+4)
+	expected := uint16(1)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, peer, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, msg, err := ParseError(buffer[:n]); err == nil {
+			return nil, nil, &testError{code, msg}
+		}
+		if options, err := ParseOACK(buffer[:n]); err == nil {
+			oack = options
+			if v, ok := options["blksize"]; ok {
+				blockSize, _ = atoi(v)
+			}
+			conn.WriteTo(MarshalACK(0), peer)
+			continue
+		}
+		block, data, err := ParseData(buffer[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block == expected {
+			content.Write(data)
+			expected++
+		}
+		conn.WriteTo(MarshalACK(block), peer)
+		if block == expected-1 && len(data) < blockSize {
+			return content.Bytes(), oack, nil
+		}
+	}
+}
+
+type testError struct {
+	code ErrorCode
+	msg  string
+}
+
+func (e *testError) Error() string {
+	return e.msg
+}
+
+func errorCodeOf(err error) ErrorCode {
+	if e, ok := err.(*testError); ok {
+		return e.code
+	}
+	return 0xffff
+}
+
+func TestRead(t *testing.T) {
+	s, addr := startTestServer(t)
+	for _, size := range []int{0, 100, DefaultBlockSize, 3*DefaultBlockSize + 1} {
+		content := bytes.Repeat([]byte{'x'}, size)
+		if err := ioutil.WriteFile(filepath.Join(s.Root, "file"), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := get(t, addr, &Request{Opcode: OpRRQ, Filename: "file", Mode: "octet"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("size %d: got %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	s, addr := startTestServer(t)
+	content := bytes.Repeat([]byte("disq"), 1000)
+	if err := ioutil.WriteFile(filepath.Join(s.Root, "pxelinux.0"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, oack, err := get(t, addr, &Request{
+		Opcode:   OpRRQ,
+		Filename: "pxelinux.0",
+		Mode:     "octet",
+		Options:  map[string]string{"blksize": "1428", "tsize": "0", "unknown": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes", len(got))
+	}
+	if oack["blksize"] != "1428" || oack["tsize"] != "4000" {
+		t.Errorf("unexpected OACK: %v", oack)
+	}
+	if _, ok := oack["unknown"]; ok {
+		t.Errorf("unknown option accepted: %v", oack)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	s, addr := startTestServer(t)
+	outside, err := ioutil.TempFile("", "disq-tftp-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outside.Name())
+	outside.WriteString("secret")
+	outside.Close()
+	if err := os.Mkdir(filepath.Join(s.Root, "boot"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.Root, "boot", "grubx64.efi"), []byte("grub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside.Name(), filepath.Join(s.Root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	rel, _ := filepath.Rel(s.Root, outside.Name())
+
+	// Traversals never go out of the root.
+	for _, name := range []string{rel, "../" + filepath.Base(outside.Name()), outside.Name(), "boot/../../" + filepath.Base(outside.Name())} {
+		_, _, err := get(t, addr, &Request{Opcode: OpRRQ, Filename: name, Mode: "octet"})
+		if errorCodeOf(err) != ErrFileNotFound {
+			t.Errorf("%s: expected file not found, got %v", name, err)
+		}
+	}
+	_, _, err = get(t, addr, &Request{Opcode: OpRRQ, Filename: "link", Mode: "octet"})
+	if errorCodeOf(err) != ErrAccessViolation {
+		t.Errorf("symlink: expected access violation, got %v", err)
+	}
+	// Backslashes and leading slashes are accepted.
+	for _, name := range []string{"boot\\grubx64.efi", "/boot/grubx64.efi"} {
+		got, _, err := get(t, addr, &Request{Opcode: OpRRQ, Filename: name, Mode: "octet"})
+		if err != nil || string(got) != "grub" {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+	// Directories can't be read.
+	_, _, err = get(t, addr, &Request{Opcode: OpRRQ, Filename: "boot", Mode: "octet"})
+	if errorCodeOf(err) != ErrFileNotFound {
+		t.Errorf("directory: expected file not found, got %v", err)
+	}
+}
+
+func TestWriteRefused(t *testing.T) {
+	s, addr := startTestServer(t)
+	_, _, err := get(t, addr, &Request{Opcode: OpWRQ, Filename: "new", Mode: "octet"})
+	if errorCodeOf(err) != ErrAccessViolation {
+		t.Errorf("expected access violation, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, "new")); !os.IsNotExist(err) {
+		t.Errorf("file created: %v", err)
+	}
+	_, _, err = get(t, addr, &Request{Opcode: OpRRQ, Filename: "new", Mode: "netascii"})
+	if errorCodeOf(err) != ErrIllegalOperation {
+		t.Errorf("expected illegal operation, got %v", err)
+	}
+}